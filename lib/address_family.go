@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"DNSServer/lib/structures"
+	"fmt"
+	"net"
+)
+
+// AddressFamilyPreference tells which ip versions are used to reach upstream servers
+type AddressFamilyPreference int
+
+const (
+	PreferIPv4 AddressFamilyPreference = iota
+	PreferIPv6
+	IPv4Only
+	IPv6Only
+)
+
+func ParseAddressFamilyPreference(preference string) (AddressFamilyPreference, error) {
+	switch preference {
+	case "prefer-ipv4":
+		return PreferIPv4, nil
+	case "prefer-ipv6":
+		return PreferIPv6, nil
+	case "ipv4-only":
+		return IPv4Only, nil
+	case "ipv6-only":
+		return IPv6Only, nil
+	}
+	return 0, fmt.Errorf("unknown address family preference %q, expected prefer-ipv4, prefer-ipv6, ipv4-only or ipv6-only", preference)
+}
+
+func isIPv6(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && ip.To4() == nil
+}
+
+// isAllowedAddress tells if server could be asked with UpstreamAddressFamily
+func isAllowedAddress(address string) bool {
+	switch UpstreamAddressFamily {
+	case IPv4Only:
+		return !isIPv6(address)
+	case IPv6Only:
+		return isIPv6(address)
+	}
+	return true
+}
+
+// isPreferredAddress tells if server should be asked before servers of the other ip version
+func isPreferredAddress(address string) bool {
+	return isIPv6(address) == (UpstreamAddressFamily == PreferIPv6 || UpstreamAddressFamily == IPv6Only)
+}
+
+// allowedAddresses filters out servers of the ip version which is not used
+func allowedAddresses(addresses []string) (allowed []string) {
+	for _, address := range addresses {
+		if isAllowedAddress(address) {
+			allowed = append(allowed, address)
+		}
+	}
+	return
+}
+
+// addressQueryTypes returns types of address records to resolve for nameservers, preferred first
+func addressQueryTypes() []structures.QType {
+	switch UpstreamAddressFamily {
+	case PreferIPv6:
+		return []structures.QType{structures.QTypeAAAA, structures.QTypeA}
+	case IPv4Only:
+		return []structures.QType{structures.QTypeA}
+	case IPv6Only:
+		return []structures.QType{structures.QTypeAAAA}
+	}
+	return []structures.QType{structures.QTypeA, structures.QTypeAAAA}
+}
+
+// isAddressRecord tells if record is A or AAAA
+func isAddressRecord(record *structures.DNSRecord) bool {
+	return record.Type == structures.RecordTypeA || record.Type == structures.RecordTypeAAAA
+}
@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"DNSServer/lib/helpers"
+	"DNSServer/lib/structures"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// inBailiwickOf makes ask sanitize responses of servers of zone, responses
+// are classified again after the records out of bailiwick are removed
+func inBailiwickOf(zone string, ask zoneAsker) zoneAsker {
+	return func(ctx context.Context, query *structures.DNSMessage) (responseKind, *structures.DNSMessage, error) {
+		_, response, err := ask(ctx, query)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		sanitizeResponse(response, zone, query.Questions[0])
+		kind := classifyResponse(response)
+		if kind == responseReferral && referralZone(response) == "" {
+			return kind, nil, fmt.Errorf("response has no nameservers in zone %q: %w", zone, errNoNameservers)
+		}
+
+		return kind, response, nil
+	}
+}
+
+// sanitizeResponse removes records of response which servers of zone are not
+// authoritative for (out of bailiwick) or which are not related to question,
+// so they could not poison the caches. Left records are:
+//   - answer: RRsets of the question name and of the CNAME chain starting from it
+//   - authority: NS and SOA of zones enclosing the answered names
+//   - additional: addresses of the nameservers from answer and authority, and OPT
+//
+// All of them have to be within zone.
+func sanitizeResponse(response *structures.DNSMessage, zone string, question *structures.DNSQuestion) {
+	inBailiwick := func(record *structures.DNSRecord) bool {
+		return helpers.IsSubdomain(record.Name, zone)
+	}
+
+	// CNAMEs could be in any order, so the chain is collected until it stops growing
+	answeredNames := map[string]bool{strings.ToLower(question.QName): true}
+	for grown := true; grown; {
+		grown = false
+		for _, record := range response.Answer {
+			cname, ok := record.Data.(*structures.CNAME)
+			if !ok || !answeredNames[strings.ToLower(record.Name)] || !inBailiwick(record) {
+				continue
+			}
+
+			target := strings.ToLower(cname.Target)
+			if !answeredNames[target] {
+				answeredNames[target] = true
+				grown = true
+			}
+		}
+	}
+
+	var answer []*structures.DNSRecord
+	nameservers := make(map[string]bool)
+	for _, record := range response.Answer {
+		if !answeredNames[strings.ToLower(record.Name)] || !inBailiwick(record) ||
+			!answersType(record, question.QType) {
+			log.Printf("dropping unsolicited answer %s type %d from zone %q", record.Name, record.Type, zone)
+			continue
+		}
+
+		if record.Type == structures.RecordTypeNS {
+			nameservers[strings.ToLower(record.RDataRepresentation)] = true
+		}
+		answer = append(answer, record)
+	}
+
+	var authority []*structures.DNSRecord
+	for _, record := range response.Authority {
+		if (record.Type != structures.RecordTypeNS && record.Type != structures.RecordTypeSOA) ||
+			!inBailiwick(record) || !enclosesAny(record.Name, answeredNames) {
+			log.Printf("dropping authority %s type %d out of zone %q", record.Name, record.Type, zone)
+			continue
+		}
+
+		if record.Type == structures.RecordTypeNS {
+			nameservers[strings.ToLower(record.RDataRepresentation)] = true
+		}
+		authority = append(authority, record)
+	}
+
+	var additional []*structures.DNSRecord
+	for _, record := range response.Additional {
+		if record.Type == structures.RecordTypeOPT {
+			additional = append(additional, record)
+			continue
+		}
+
+		isAddress := record.Type == structures.RecordTypeA || record.Type == structures.RecordTypeAAAA
+		if !isAddress || !nameservers[strings.ToLower(record.Name)] || !inBailiwick(record) {
+			log.Printf("dropping additional %s type %d out of zone %q", record.Name, record.Type, zone)
+			continue
+		}
+		additional = append(additional, record)
+	}
+
+	response.Answer = answer
+	response.Authority = authority
+	response.Additional = additional
+}
+
+// answersType tells if record could be in the answer for qtype, CNAMEs answer any type
+func answersType(record *structures.DNSRecord, qtype structures.QType) bool {
+	return qtype == structures.QTypeALL || record.Type == structures.RecordTypeCNAME ||
+		record.Type == structures.RecordType(qtype)
+}
+
+// enclosesAny tells if zone is equal to or above some of names
+func enclosesAny(zone string, names map[string]bool) bool {
+	for name := range names {
+		if helpers.IsSubdomain(name, zone) {
+			return true
+		}
+	}
+	return false
+}
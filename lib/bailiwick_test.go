@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"DNSServer/lib/structures"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestSanitizeResponse(t *testing.T) {
+	record := func(name string, data structures.RData) *structures.DNSRecord {
+		return structures.NewDNSRecord(name, structures.RecordClassIN, 3600, data)
+	}
+	a := func(name, ip string) *structures.DNSRecord {
+		return record(name, &structures.A{Address: net.ParseIP(ip).To4()})
+	}
+	ns := func(name, host string) *structures.DNSRecord {
+		return record(name, &structures.NS{Host: host})
+	}
+	soa := func(name string) *structures.DNSRecord {
+		return record(name, &structures.SOA{MName: "ns1." + name, RName: "hostmaster." + name})
+	}
+	cname := func(name, target string) *structures.DNSRecord {
+		return record(name, &structures.CNAME{Target: target})
+	}
+	records := func(records ...*structures.DNSRecord) []*structures.DNSRecord { return records }
+
+	tests := []struct {
+		name     string
+		zone     string
+		qname    string
+		qtype    structures.QType
+		response *structures.DNSMessage
+
+		wantAnswer, wantAuthority, wantAdditional []*structures.DNSRecord
+	}{
+		{
+			name:  "out of zone glue is dropped",
+			zone:  "com",
+			qname: "www.example.com",
+			qtype: structures.QTypeA,
+			response: structures.NewDNSMessage(structures.NewDNSAnswerHeader(), nil, nil,
+				records(ns("example.com", "ns1.example.com"), ns("example.com", "ns.example.net")),
+				records(a("ns1.example.com", "192.0.2.53"), a("ns.example.net", "198.51.100.53"))),
+			wantAuthority:  records(ns("example.com", "ns1.example.com"), ns("example.com", "ns.example.net")),
+			wantAdditional: records(a("ns1.example.com", "192.0.2.53")),
+		},
+		{
+			name:  "glue of names which are not nameservers is dropped",
+			zone:  "com",
+			qname: "www.example.com",
+			qtype: structures.QTypeA,
+			response: structures.NewDNSMessage(structures.NewDNSAnswerHeader(), nil, nil,
+				records(ns("example.com", "ns1.example.com")),
+				records(a("ns1.example.com", "192.0.2.53"), a("www.bank.com", "203.0.113.1"))),
+			wantAuthority:  records(ns("example.com", "ns1.example.com")),
+			wantAdditional: records(a("ns1.example.com", "192.0.2.53")),
+		},
+		{
+			name:  "unsolicited answer rrsets are dropped",
+			zone:  "example.com",
+			qname: "www.example.com",
+			qtype: structures.QTypeA,
+			response: structures.NewDNSMessage(structures.NewDNSAnswerHeader(), nil,
+				records(
+					a("www.example.com", "192.0.2.1"),
+					a("mail.example.com", "192.0.2.2"),
+					record("www.example.com", &structures.MX{Preference: 10, Exchange: "mail.example.com"}),
+				), nil, nil),
+			wantAnswer: records(a("www.example.com", "192.0.2.1")),
+		},
+		{
+			name:  "in bailiwick cname chain is kept, its out of zone target is dropped",
+			zone:  "example.com",
+			qname: "www.example.com",
+			qtype: structures.QTypeA,
+			response: structures.NewDNSMessage(structures.NewDNSAnswerHeader(), nil,
+				records(
+					// the chain is not in order
+					cname("web.example.com", "cdn.example.net"),
+					cname("www.example.com", "web.example.com"),
+					a("cdn.example.net", "198.51.100.1"),
+				), nil, nil),
+			wantAnswer: records(cname("web.example.com", "cdn.example.net"), cname("www.example.com", "web.example.com")),
+		},
+		{
+			name:  "soa and ns which do not enclose the name are dropped",
+			zone:  "example.com",
+			qname: "www.example.com",
+			qtype: structures.QTypeA,
+			response: structures.NewDNSMessage(structures.NewDNSAnswerHeader(), nil, nil,
+				records(
+					soa("example.com"),
+					soa("other.example.com"),
+					ns("other.example.com", "ns1.example.com"),
+					ns("example.net", "ns1.example.net"),
+				),
+				records(a("ns1.example.com", "192.0.2.53"))),
+			wantAuthority: records(soa("example.com")),
+		},
+		{
+			name:  "ns of the root are kept in priming answer",
+			zone:  "",
+			qname: "",
+			qtype: structures.QTypeNS,
+			response: structures.NewDNSMessage(structures.NewDNSAnswerHeader(), nil,
+				records(ns("", "a.root-servers.net")), nil,
+				records(a("a.root-servers.net", "198.41.0.4"))),
+			wantAnswer:     records(ns("", "a.root-servers.net")),
+			wantAdditional: records(a("a.root-servers.net", "198.41.0.4")),
+		},
+	}
+
+	for _, test := range tests {
+		question := structures.NewDNSQuestion(test.qname, test.qtype, structures.QClassIN)
+		sanitizeResponse(test.response, test.zone, question)
+
+		compareSanitized(t, test.name+": answer", test.response.Answer, test.wantAnswer)
+		compareSanitized(t, test.name+": authority", test.response.Authority, test.wantAuthority)
+		compareSanitized(t, test.name+": additional", test.response.Additional, test.wantAdditional)
+	}
+}
+
+func compareSanitized(t *testing.T, section string, got, want []*structures.DNSRecord) {
+	t.Helper()
+
+	describe := func(records []*structures.DNSRecord) (descriptions []string) {
+		for _, record := range records {
+			descriptions = append(descriptions, fmt.Sprintf("%s %d %s", record.Name, record.Type, record.RDataRepresentation))
+		}
+		return
+	}
+
+	if fmt.Sprint(describe(got)) != fmt.Sprint(describe(want)) {
+		t.Errorf("%s: got %q, want %q", section, describe(got), describe(want))
+	}
+}
@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	errBudgetExhausted = errors.New("resolution budget is exhausted")
+	errReferralDepth   = errors.New("too many referrals")
+	errReferralLoop    = errors.New("referral does not lead closer to the name")
+)
+
+// resolutionBudget limits work done for one client query, all CNAME hops
+// and glueless nameserver lookups made on its behalf spend the same budget.
+// It protects from endless delegations and from referrals which make us
+// send lots of queries (https://www.nxnsattack.com/).
+type resolutionBudget struct {
+	mutex sync.Mutex
+
+	queriesLeft   int
+	gluelessLeft  int
+	referralsLeft int
+
+	// nameservers are names of servers already used, at most nameserversLimit of them
+	nameservers      map[string]bool
+	nameserversLimit int
+}
+
+type budgetContextKey struct{}
+
+func withResolutionBudget(ctx context.Context) context.Context {
+	budget := &resolutionBudget{
+		queriesLeft:   MaxUpstreamQueries,
+		gluelessLeft:  MaxGluelessLookups,
+		referralsLeft: MaxReferralDepth,
+		nameservers:   make(map[string]bool),
+
+		// every referral could use its whole fan out
+		nameserversLimit: MaxNSFanOut * MaxReferralDepth,
+	}
+	return context.WithValue(ctx, budgetContextKey{}, budget)
+}
+
+// budgetFromContext returns budget of the client query, nil budget is unlimited
+func budgetFromContext(ctx context.Context) *resolutionBudget {
+	budget, _ := ctx.Value(budgetContextKey{}).(*resolutionBudget)
+	return budget
+}
+
+// spendQuery is called before every exchange with an upstream server
+func (b *resolutionBudget) spendQuery() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.queriesLeft <= 0 {
+		return errBudgetExhausted
+	}
+	b.queriesLeft -= 1
+	return nil
+}
+
+// spendGlueless is called before resolving address of a nameserver without glue
+func (b *resolutionBudget) spendGlueless() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.gluelessLeft <= 0 {
+		return errBudgetExhausted
+	}
+	b.gluelessLeft -= 1
+	return nil
+}
+
+// spendReferral is called before following a referral
+func (b *resolutionBudget) spendReferral() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.referralsLeft <= 0 {
+		return errReferralDepth
+	}
+	b.referralsLeft -= 1
+	return nil
+}
+
+// spendNameservers returns names of the referral nameservers which could be
+// used, at most MaxNSFanOut of them. Names used before for the same client
+// query are free, new ones are taken while the total limit allows.
+func (b *resolutionBudget) spendNameservers(names []string) (allowed []string) {
+	if b == nil {
+		if len(names) > MaxNSFanOut {
+			return names[:MaxNSFanOut]
+		}
+		return names
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, name := range names {
+		if len(allowed) >= MaxNSFanOut {
+			break
+		}
+		if !b.nameservers[name] {
+			if len(b.nameservers) >= b.nameserversLimit {
+				continue
+			}
+			b.nameservers[name] = true
+		}
+		allowed = append(allowed, name)
+	}
+	return
+}
+
+func (b *resolutionBudget) exhausted() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.queriesLeft <= 0
+}
@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBudgetLimitsReferralDepth(t *testing.T) {
+	budget := budgetFromContext(withResolutionBudget(context.Background()))
+
+	for i := 0; i < MaxReferralDepth; i++ {
+		if err := budget.spendReferral(); err != nil {
+			t.Fatalf("referral %d: %s", i, err)
+		}
+	}
+	if err := budget.spendReferral(); !errors.Is(err, errReferralDepth) {
+		t.Errorf("got %v, want %v", err, errReferralDepth)
+	}
+}
+
+func TestBudgetLimitsNameservers(t *testing.T) {
+	budget := budgetFromContext(withResolutionBudget(context.Background()))
+
+	names := make([]string, 2*MaxNSFanOut)
+	for i := range names {
+		names[i] = fmt.Sprintf("ns%d.example.", i)
+	}
+
+	allowed := budget.spendNameservers(names)
+	if len(allowed) != MaxNSFanOut {
+		t.Fatalf("got %d nameservers, want %d", len(allowed), MaxNSFanOut)
+	}
+
+	// the same referral asked again does not spend anything
+	for i := 0; i < 3; i++ {
+		if again := budget.spendNameservers(allowed); len(again) != MaxNSFanOut {
+			t.Fatalf("got %d nameservers again, want %d", len(again), MaxNSFanOut)
+		}
+	}
+	if len(budget.nameservers) != MaxNSFanOut {
+		t.Errorf("%d nameservers spent, want %d", len(budget.nameservers), MaxNSFanOut)
+	}
+
+	// new names are taken only while the total limit allows
+	for i := 0; len(budget.nameservers) < budget.nameserversLimit; i++ {
+		budget.spendNameservers([]string{fmt.Sprintf("other%d.example.", i)})
+	}
+	if left := budget.spendNameservers([]string{"last.example."}); len(left) != 0 {
+		t.Errorf("got %v over the limit", left)
+	}
+}
+
+func TestNilBudgetKeepsFanOut(t *testing.T) {
+	var budget *resolutionBudget
+
+	names := make([]string, MaxNSFanOut+1)
+	if allowed := budget.spendNameservers(names); len(allowed) != MaxNSFanOut {
+		t.Errorf("got %d nameservers, want %d", len(allowed), MaxNSFanOut)
+	}
+	if err := budget.spendReferral(); err != nil {
+		t.Errorf("nil budget: %s", err)
+	}
+}
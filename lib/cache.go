@@ -0,0 +1,37 @@
+package lib
+
+import (
+	"DNSServer/lib/structures"
+	"log"
+	"time"
+)
+
+// StartCache makes the answers and delegation caches with limits from the
+// configuration and starts removing expired entries from them every
+// CacheSweepInterval. It has to be called before the server starts receiving requests.
+func StartCache() {
+	cache = structures.NewQueryCache(MaxCacheEntries, MaxCacheBytes)
+	delegations = structures.NewDelegationCache(MaxDelegationEntries)
+	go sweepCache(cache, delegations)
+}
+
+// CacheStatistics returns the state and counters of the answers cache
+func CacheStatistics() structures.CacheStatistics {
+	return cache.Statistics()
+}
+
+// DelegationCacheSize returns how many zones and nameserver names are in the delegation cache
+func DelegationCacheSize() (zones, nameservers int) {
+	return delegations.Len()
+}
+
+func sweepCache(queryCache *structures.QueryCache, delegationCache *structures.DelegationCache) {
+	for range time.Tick(CacheSweepInterval) {
+		if removed := queryCache.RemoveExpired(); removed != 0 {
+			log.Printf("removed %d expired entries from cache", removed)
+		}
+		if removed := delegationCache.RemoveExpired(); removed != 0 {
+			log.Printf("removed %d expired zones and nameservers from delegation cache", removed)
+		}
+	}
+}
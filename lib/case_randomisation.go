@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"DNSServer/lib/helpers"
+	"DNSServer/lib/structures"
+	"crypto/rand"
+	"errors"
+	"log"
+	"strings"
+)
+
+// errCaseMismatch is returned when response has the question of the query,
+// but with letters in other case, the server does not preserve case
+var errCaseMismatch = errors.New("response question differs from the query in letter case")
+
+// randomiseCase returns copies of questions with letters of names in random case,
+// the response has to echo them exactly, which adds a bit of entropy per letter
+// https://datatracker.ietf.org/doc/html/draft-vixie-dnsext-dns0x20-00
+func randomiseCase(questions []*structures.DNSQuestion) []*structures.DNSQuestion {
+	randomised := make([]*structures.DNSQuestion, len(questions))
+	for i, question := range questions {
+		questionCopy := *question
+		questionCopy.QName = randomiseNameCase(question.QName)
+		randomised[i] = &questionCopy
+	}
+	return randomised
+}
+
+func randomiseNameCase(name string) string {
+	bits := make([]byte, (len(name)+7)/8)
+	if _, err := rand.Read(bits); err != nil {
+		log.Printf("failed to read random bits, name is sent as is: %s", err)
+		return name
+	}
+
+	randomised := []byte(strings.ToLower(name))
+	for i, letter := range randomised {
+		if letter >= 'a' && letter <= 'z' && bits[i/8]&(1<<(i%8)) != 0 {
+			randomised[i] = letter - 'a' + 'A'
+		}
+	}
+	return string(randomised)
+}
+
+// restoreQuestionCase puts names of the query back into the response, so
+// randomised case does not get to the cache and to the clients. Owners and
+// names inside RDATA could be compressed to point into any suffix of the
+// name, so every suffix gets its original case back.
+func restoreQuestionCase(response *structures.DNSMessage, query *structures.DNSMessage) {
+	if len(response.Questions) != len(query.Questions) {
+		return
+	}
+
+	for i, question := range response.Questions {
+		original := query.Questions[i].QName
+		if question.QName == original {
+			continue
+		}
+
+		for _, section := range [][]*structures.DNSRecord{response.Answer, response.Authority, response.Additional} {
+			for _, record := range section {
+				restoreRecordCase(record, original)
+			}
+		}
+		question.QName = original
+	}
+}
+
+func restoreRecordCase(record *structures.DNSRecord, original string) {
+	record.Name = restoreNameCase(record.Name, original)
+
+	switch data := record.Data.(type) {
+	case *structures.NS:
+		data.Host = restoreNameCase(data.Host, original)
+	case *structures.CNAME:
+		data.Target = restoreNameCase(data.Target, original)
+	case *structures.PTR:
+		data.Target = restoreNameCase(data.Target, original)
+	case *structures.MX:
+		data.Exchange = restoreNameCase(data.Exchange, original)
+	case *structures.SRV:
+		data.Target = restoreNameCase(data.Target, original)
+	case *structures.SOA:
+		data.MName = restoreNameCase(data.MName, original)
+		data.RName = restoreNameCase(data.RName, original)
+	default:
+		return
+	}
+	record.RDataRepresentation = record.Data.String()
+}
+
+// restoreNameCase replaces the longest suffix of name which is a suffix of
+// original, compared case-insensitively, with that suffix of original
+func restoreNameCase(name, original string) string {
+	for suffix := original; suffix != ""; suffix = helpers.ParentName(suffix) {
+		if len(name) == len(suffix) && strings.EqualFold(name, suffix) {
+			return suffix
+		}
+
+		prefixLength := len(name) - len(suffix)
+		if prefixLength > 0 && name[prefixLength-1] == '.' && strings.EqualFold(name[prefixLength:], suffix) {
+			return name[:prefixLength] + suffix
+		}
+	}
+	return name
+}
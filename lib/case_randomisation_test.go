@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"DNSServer/lib/structures"
+	"net"
+	"testing"
+)
+
+func TestRestoreQuestionCase(t *testing.T) {
+	query := structures.NewQueryDNSMessage(structures.NewDNSQuestion("www.Example.com", 1, 1))
+	randomised := query.Copy()
+	randomised.Questions = []*structures.DNSQuestion{structures.NewDNSQuestion("wWw.ExAmPlE.cOm", 1, 1)}
+
+	// response of a server which has compressed names against the randomised question
+	response := structures.NewAnswerDNSMessage(randomised.Questions, []*structures.DNSRecord{
+		structures.NewDNSRecord("wWw.ExAmPlE.cOm", structures.RecordClassIN, 60, &structures.CNAME{Target: "web.ExAmPlE.cOm"}),
+		structures.NewDNSRecord("web.ExAmPlE.cOm", structures.RecordClassIN, 60, &structures.A{Address: net.ParseIP("192.0.2.1").To4()}),
+	})
+	response.Authority = []*structures.DNSRecord{
+		structures.NewDNSRecord("ExAmPlE.cOm", structures.RecordClassIN, 60, &structures.NS{Host: "ns1.ExAmPlE.cOm"}),
+		structures.NewDNSRecord("cOm", structures.RecordClassIN, 60, &structures.SOA{MName: "a.gtld-servers.NET", RName: "nstld.cOm"}),
+	}
+	response.Additional = []*structures.DNSRecord{
+		structures.NewDNSRecord("ns1.ExAmPlE.cOm", structures.RecordClassIN, 60, &structures.A{Address: net.ParseIP("192.0.2.53").To4()}),
+	}
+
+	restoreQuestionCase(response, query)
+
+	want := []struct{ name, data string }{
+		{"www.Example.com", "web.Example.com"},
+		{"web.Example.com", "192.0.2.1"},
+		{"Example.com", "ns1.Example.com"},
+		{"com", "a.gtld-servers.NET nstld.com 0 0 0 0 0"},
+		{"ns1.Example.com", "192.0.2.53"},
+	}
+	records := append(append(response.Answer, response.Authority...), response.Additional...)
+	for i, record := range records {
+		if record.Name != want[i].name || record.RDataRepresentation != want[i].data {
+			t.Errorf("record %d: got %s %s, want %s %s", i, record.Name, record.RDataRepresentation, want[i].name, want[i].data)
+		}
+	}
+	if response.Questions[0].QName != "www.Example.com" {
+		t.Errorf("question: got %s", response.Questions[0].QName)
+	}
+}
+
+func TestRestoreNameCase(t *testing.T) {
+	tests := []struct{ name, original, want string }{
+		{"ExAmPlE.cOm", "www.example.com", "example.com"},
+		{"mail.EXAMPLE.com", "www.example.com", "mail.example.com"},
+		{"notexample.COM", "www.example.com", "notexample.com"},
+		{"example.org", "www.example.com", "example.org"},
+		{"", "www.example.com", ""},
+	}
+
+	for _, test := range tests {
+		if got := restoreNameCase(test.name, test.original); got != test.want {
+			t.Errorf("restoreNameCase(%q, %q) = %q, want %q", test.name, test.original, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"DNSServer/lib/structures"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// resolveFollowingCNAMEs resolves the question and, when answer has only an
+// alias for it, goes on with the CNAME target until records of the asked
+// type are found. Answer of the returned message has the whole chain
+// followed by the final RRset, rcode and authority come from the last answer.
+// https://datatracker.ietf.org/doc/html/rfc1034#section-5.3.3
+func resolveFollowingCNAMEs(ctx context.Context, queryMessage *structures.DNSMessage) (*structures.DNSMessage, error) {
+	question := queryMessage.Questions[0]
+
+	var (
+		chain           []*structures.DNSRecord
+		visitedNames    = map[string]bool{strings.ToLower(question.QName): true}
+		currentQuestion = question
+		currentQuery    = queryMessage
+	)
+
+	for {
+		answer, err := resolveQuestion(ctx, currentQuery)
+		if err != nil {
+			return nil, err
+		}
+
+		cnames, final, target := followCNAMEs(answer.Answer, currentQuestion)
+		chain = append(chain, cnames...)
+
+		// alias is followed only if it has led nowhere yet
+		if len(cnames) == 0 || len(final) != 0 || answer.Header.RCODE != structures.RCodeNoError {
+			if len(chain) == 0 {
+				return answer, nil
+			}
+
+			result := structures.NewAnswerDNSMessage(queryMessage.Questions, append(chain, final...))
+			result.Header.RCODE = answer.Header.RCODE
+			result.Authority = answer.Authority
+			return result, nil
+		}
+
+		if len(chain) > MaxCNAMEChainLength {
+			return nil, fmt.Errorf("CNAME chain of %s is longer than %d", question.QName, MaxCNAMEChainLength)
+		}
+
+		if visitedNames[strings.ToLower(target)] {
+			return nil, fmt.Errorf("CNAME loop for %s at %s", question.QName, target)
+		}
+		visitedNames[strings.ToLower(target)] = true
+
+		log.Printf("following CNAME of %s to %s", currentQuestion.QName, target)
+		currentQuestion = structures.NewDNSQuestion(target, question.QType, question.QClass)
+		currentQuery = structures.NewQueryDNSMessage(currentQuestion)
+	}
+}
+
+// followCNAMEs walks CNAMEs in records starting from the name of question.
+// It returns CNAMEs in chain order, records of the question type owned by
+// the end of the chain and that end. Neither is followed for CNAME and ANY questions.
+func followCNAMEs(records []*structures.DNSRecord, question *structures.DNSQuestion) (
+	chain, final []*structures.DNSRecord, target string) {
+	target = question.QName
+	followed := map[*structures.DNSRecord]bool{}
+
+	for {
+		for _, record := range records {
+			if !strings.EqualFold(record.Name, target) {
+				continue
+			}
+			if structures.QType(record.Type) == question.QType || question.QType == structures.QTypeALL {
+				final = append(final, record)
+			}
+		}
+
+		if len(final) != 0 || question.QType == structures.QTypeCNAME || question.QType == structures.QTypeALL {
+			return
+		}
+
+		var next *structures.DNSRecord
+		for _, record := range records {
+			if record.Type == structures.RecordTypeCNAME && strings.EqualFold(record.Name, target) &&
+				!followed[record] {
+				next = record
+				break
+			}
+		}
+
+		if next == nil {
+			return
+		}
+
+		followed[next] = true
+		chain = append(chain, next)
+		target = next.RDataRepresentation
+	}
+}
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"DNSServer/lib/structures"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// QueryCoalescer makes identical client queries which arrive while one of
+// them is being resolved wait for that resolution instead of starting their own
+type QueryCoalescer struct {
+	mutex sync.Mutex
+	calls map[string]*inFlightCall
+
+	resolutions  uint64
+	deduplicated uint64
+}
+
+// CoalescingStatistics tells how many client queries were resolved upstream
+// and how many of them have only waited for another identical query
+type CoalescingStatistics struct {
+	Resolutions  uint64
+	Deduplicated uint64
+}
+
+type inFlightCall struct {
+	done chan struct{}
+
+	answer *structures.DNSMessage
+	err    error
+}
+
+func NewQueryCoalescer() *QueryCoalescer {
+	return &QueryCoalescer{calls: make(map[string]*inFlightCall)}
+}
+
+// Coalescer deduplicates queries of all clients
+var Coalescer = NewQueryCoalescer()
+
+// Resolve calls resolve for the query, or waits for the result of the same
+// call already in progress. Every caller gets its own copy of the answer,
+// so it could be changed before sending to the client.
+func (c *QueryCoalescer) Resolve(ctx context.Context, query *structures.DNSMessage,
+	resolve func(ctx context.Context, query *structures.DNSMessage) (*structures.DNSMessage, error)) (
+	*structures.DNSMessage, error) {
+	key := makeInFlightKey(query.Questions[0])
+
+	c.mutex.Lock()
+	call, inProgress := c.calls[key]
+	if inProgress {
+		c.deduplicated += 1
+		c.mutex.Unlock()
+
+		log.Printf("waiting for resolution of %s already in progress", query.Questions[0].QName)
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if call.err != nil {
+			return nil, call.err
+		}
+		return call.answer.Copy(), nil
+	}
+
+	call = &inFlightCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.resolutions += 1
+	c.mutex.Unlock()
+
+	defer func() {
+		// waiters must not hang when resolution has panicked
+		if recovered := recover(); recovered != nil {
+			call.err = fmt.Errorf("resolution has panicked: %v", recovered)
+			c.finish(key, call)
+			panic(recovered)
+		}
+	}()
+
+	call.answer, call.err = resolve(ctx, query)
+	c.finish(key, call)
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	return call.answer.Copy(), nil
+}
+
+// Statistics returns counters of coalesced queries
+func (c *QueryCoalescer) Statistics() CoalescingStatistics {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return CoalescingStatistics{
+		Resolutions:  c.resolutions,
+		Deduplicated: c.deduplicated,
+	}
+}
+
+func (c *QueryCoalescer) finish(key string, call *inFlightCall) {
+	c.mutex.Lock()
+	delete(c.calls, key)
+	c.mutex.Unlock()
+
+	close(call.done)
+}
+
+// makeInFlightKey identifies the query, names are case-insensitive
+func makeInFlightKey(question *structures.DNSQuestion) string {
+	return fmt.Sprintf("%s-%d-%d", strings.ToLower(question.QName), question.QType, question.QClass)
+}
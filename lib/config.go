@@ -0,0 +1,90 @@
+package lib
+
+import "time"
+
+// EDNSBufferSize is the udp payload size advertised in OPT records both to
+// upstream servers and to clients. 1232 is the value recommended by
+// https://www.dnsflagday.net/2020/ to avoid ip fragmentation.
+var EDNSBufferSize uint16 = 1232
+
+// MaxTCPConnections is how many clients could be connected over tcp at once
+var MaxTCPConnections = 128
+
+// TCPIdleTimeout is how long a tcp connection without queries in progress is kept open
+// https://datatracker.ietf.org/doc/html/rfc7766#section-6.2.3
+var TCPIdleTimeout = 10 * time.Second
+
+// MaxTCPQueriesPerConnection is how many queries of one tcp connection could be
+// resolved at once, further queries are not read until some of them are answered
+var MaxTCPQueriesPerConnection = 32
+
+// UpstreamTimeout limits one exchange with an upstream server, including connection setup
+var UpstreamTimeout = 2 * time.Second
+
+// UpstreamAttempts is how many times each upstream server is asked before moving to the next one
+var UpstreamAttempts = 2
+
+// QueryTimeout limits the whole resolution of one client query
+var QueryTimeout = 10 * time.Second
+
+// MaxCNAMEChainLength is how many CNAMEs are followed for one client query
+var MaxCNAMEChainLength = 8
+
+// MaxReferralDepth is how many referrals could be followed for one client query,
+// including referrals met while following CNAMEs and resolving nameservers without glue
+var MaxReferralDepth = 32
+
+// MaxUpstreamQueries is how many queries could be sent upstream for one client query
+var MaxUpstreamQueries = 100
+
+// MaxGluelessLookups is how many nameserver addresses without glue could be
+// resolved for one client query
+var MaxGluelessLookups = 8
+
+// MaxNSFanOut is how many nameservers of one referral are used, the rest are ignored.
+// One client query could use MaxNSFanOut * MaxReferralDepth different nameservers at most.
+var MaxNSFanOut = 8
+
+// MaxParallelGluelessLookups is how many nameservers without glue of one referral are resolved at once
+var MaxParallelGluelessLookups = 3
+
+// ServerBackoff is how long a failed upstream server is asked only as the last
+// resort, it doubles with every failure in a row up to MaxServerBackoff
+var ServerBackoff = 5 * time.Second
+
+// MaxServerBackoff limits backoff of the upstream server which keeps failing
+var MaxServerBackoff = 5 * time.Minute
+
+// Forwarders are servers all queries are sent to with recursion desired,
+// queries are resolved by iteration from the root when there are none
+var Forwarders []string
+
+// ConditionalForwarders maps zone to servers queries for names in it are
+// forwarded to, the longest zone enclosing the name is used before Forwarders
+var ConditionalForwarders = make(map[string][]string)
+
+// QNAMEMinimisation tells how much of the name is revealed to servers of the zones above it
+var QNAMEMinimisation = QNAMEMinimisationRelaxed
+
+// ListenAddresses are ip addresses the server accepts queries on, port 53 is used on each.
+// Addresses the host does not have are skipped.
+var ListenAddresses = []string{"127.0.0.1", "::1"}
+
+// UpstreamAddressFamily tells which ip versions are used to reach upstream servers
+var UpstreamAddressFamily = PreferIPv4
+
+// CaseRandomisation turns on 0x20 encoding of names in upstream queries
+var CaseRandomisation = false
+
+// MaxCacheEntries limits how many answers are cached, 0 means no limit
+var MaxCacheEntries = 100000
+
+// MaxCacheBytes limits approximate memory taken by cached answers, 0 means no limit
+var MaxCacheBytes = 64 << 20
+
+// MaxDelegationEntries limits how many zones and how many nameserver names are
+// kept in the delegation cache, 0 means no limit
+var MaxDelegationEntries = 20000
+
+// CacheSweepInterval is how often expired answers and delegations are removed from the caches
+var CacheSweepInterval = time.Minute
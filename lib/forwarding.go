@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"DNSServer/lib/helpers"
+	"DNSServer/lib/structures"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+var errForwarderReferral = errors.New("forwarder has answered with a referral instead of recursion")
+
+// forwardersFor returns servers which queries for name have to be forwarded to.
+// Conditional forwarders of the longest zone enclosing name win, then
+// Forwarders are used. ok is false when name has to be resolved by iteration.
+func forwardersFor(name string) (zone string, servers []string, ok bool) {
+	matchedLabels := -1
+	for forwardedZone, zoneServers := range ConditionalForwarders {
+		if !helpers.IsSubdomain(name, forwardedZone) {
+			continue
+		}
+
+		labels := countLabels(forwardedZone)
+		if labels > matchedLabels {
+			zone, servers, matchedLabels = forwardedZone, zoneServers, labels
+		}
+	}
+
+	if servers != nil {
+		return zone, servers, true
+	}
+
+	if len(Forwarders) != 0 {
+		return "", Forwarders, true
+	}
+
+	return "", nil, false
+}
+
+func countLabels(zone string) int {
+	zone = strings.TrimSuffix(zone, ".")
+	if zone == "" {
+		return 0
+	}
+	return strings.Count(zone, ".") + 1
+}
+
+// forwardQuery asks forwarders to resolve the question recursively, they
+// have to answer with the data, NXDOMAIN or NODATA, never with a referral
+func forwardQuery(ctx context.Context, queryMessage *structures.DNSMessage, zone string, forwarders ...string) (
+	kind responseKind, lastReceivedMsg *structures.DNSMessage, err error) {
+	upstreamQuery := structures.NewQueryDNSMessage(queryMessage.Questions...)
+	upstreamQuery.Header.RD = 1
+
+	_, lastReceivedMsg, err = askServers(ctx, upstreamQuery, forwarders...)
+	if err != nil {
+		return
+	}
+
+	// forwarders of a zone are trusted only with names of the zone
+	sanitizeResponse(lastReceivedMsg, zone, queryMessage.Questions[0])
+	kind = classifyResponse(lastReceivedMsg)
+
+	if kind == responseReferral {
+		return kind, nil, fmt.Errorf("%w: question %s", errForwarderReferral, queryMessage.Questions[0].QName)
+	}
+
+	log.Printf("%s is resolved by forwarders", queryMessage.Questions[0].QName)
+	return
+}
@@ -3,71 +3,196 @@ package helpers
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"strings"
 )
 
+const (
+	// MaxLabelLength labels must be 63 characters or less
+	MaxLabelLength = 63
+
+	// MaxNameLength names must be 255 octets or less in their wire form
+	MaxNameLength = 255
+
+	// maxCompressionOffset is the biggest offset which fits into 14 bits of a compression pointer.
+	maxCompressionOffset = 0x3FFF
+
+	// MaxCompressionPointers is how many pointers one name could follow. Jumps
+	// add nothing to the name length, so without the limit a long chain of
+	// pointers is followed as a whole for every name which points into it.
+	// A name of 255 octets has at most 127 labels, so legitimate names never
+	// need more pointers than that.
+	MaxCompressionPointers = 126
+)
+
+var (
+	ErrNameOutOfBounds = errors.New("domain name runs past the end of message")
+	ErrLabelTooLong    = errors.New("label is longer than 63 octets or has unknown type")
+	ErrNameTooLong     = errors.New("domain name is longer than 255 octets")
+	ErrPointerLoop     = errors.New("compression pointers make a loop")
+	ErrForwardPointer  = errors.New("compression pointer points forward")
+	ErrTooManyPointers = errors.New("domain name follows too many compression pointers")
+)
+
 func WriteLabel(buffer *bytes.Buffer, label string) {
 	labels := strings.Split(label, ".")
 	for _, label := range labels {
+		if len(label) == 0 {
+			// root label and trailing dot are written as the terminating zero octet
+			continue
+		}
 		buffer.WriteByte(uint8(len(label)))
 		buffer.WriteString(label)
 	}
 	buffer.WriteByte(0)
 }
 
-func ReadLabel(bufferWithLabelStarting *bytes.Buffer, fullMessage []byte) (label string, shouldUnreadByte bool) {
+// WriteCompressedLabel writes domain name using message compression as specified in
+// https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.4
+//
+// buffer must contain the message from its very first octet, because pointers
+// are offsets from the start of the message. namesPositions maps names and
+// their suffixes that are already written to their offsets, it is updated
+// with suffixes of label. A nil map disables compression.
+func WriteCompressedLabel(buffer *bytes.Buffer, label string, namesPositions map[string]int) {
+	if namesPositions == nil {
+		WriteLabel(buffer, label)
+		return
+	}
+
+	var labels []string
+	for _, part := range strings.Split(label, ".") {
+		if len(part) != 0 {
+			labels = append(labels, part)
+		}
+	}
+
+	for i := range labels {
+		suffix := strings.Join(labels[i:], ".")
+
+		if position, ok := namesPositions[suffix]; ok {
+			_ = binary.Write(buffer, binary.BigEndian, uint16(0xC000|position))
+			return
+		}
+
+		if buffer.Len() <= maxCompressionOffset {
+			namesPositions[suffix] = buffer.Len()
+		}
+
+		buffer.WriteByte(uint8(len(labels[i])))
+		buffer.WriteString(labels[i])
+	}
+
+	buffer.WriteByte(0)
+}
+
+// ReadName reads a domain name that starts at offset of fullMessage.
+//
+// The compression scheme allows a domain name in a message to be represented as either:
+//   - a sequence of labels ending in a zero octet
+//   - a pointer
+//   - a sequence of labels ending with a pointer
+//
+// nextOffset points right after the name at the place where it started,
+// octets reached by following pointers are not counted.
+// Pointers must point backwards and at most MaxCompressionPointers of them are followed.
+func ReadName(fullMessage []byte, offset int) (name string, nextOffset int, err error) {
 	var (
-		parts              []string
-		hadRealLabelBefore bool
+		parts        []string
+		nameLength   = 1 // terminating zero octet
+		jumped       bool
+		jumps        int
+		visitedJumps = make(map[int]bool)
 	)
 
+	position := offset
 	for {
-		lengthOfName, _ := bufferWithLabelStarting.ReadByte()
+		if position >= len(fullMessage) {
+			return "", 0, ErrNameOutOfBounds
+		}
+
+		lengthOfLabel := fullMessage[position]
 
-		if lengthOfName == 0 {
+		if lengthOfLabel == 0 {
+			position += 1
 			break
 		}
 
-		if lengthOfName > 63 { // Compressed part
-			// The compression scheme allows a domain name in a message to be represented as either:
-			//   - a sequence of labels ending in a zero octet
-			//   - a pointer
-			//   - a sequence of labels ending with a pointer
-
-			_ = bufferWithLabelStarting.UnreadByte()
-			compressed := readCompressed(bufferWithLabelStarting, fullMessage)
-			parts = append(parts, compressed)
-			shouldUnreadByte = true
-			if hadRealLabelBefore {
-				break
+		if lengthOfLabel&0xC0 == 0xC0 { // Compressed part
+			if position+1 >= len(fullMessage) {
+				return "", 0, ErrNameOutOfBounds
+			}
+
+			pointTo := int(lengthOfLabel&0x3F)<<8 | int(fullMessage[position+1])
+			if visitedJumps[pointTo] || pointTo == position {
+				return "", 0, ErrPointerLoop
+			}
+			if pointTo > position {
+				// only prior occurrences of a name could be referenced
+				return "", 0, ErrForwardPointer
 			}
+			visitedJumps[pointTo] = true
 
+			jumps += 1
+			if jumps > MaxCompressionPointers {
+				return "", 0, ErrTooManyPointers
+			}
+
+			if !jumped {
+				nextOffset = position + 2
+				jumped = true
+			}
+
+			position = pointTo
 			continue
 		}
 
-		labelBytes := make([]byte, lengthOfName)
-		_, _ = bufferWithLabelStarting.Read(labelBytes)
+		if lengthOfLabel > MaxLabelLength {
+			return "", 0, ErrLabelTooLong
+		}
+
+		nameLength += int(lengthOfLabel) + 1
+		if nameLength > MaxNameLength {
+			return "", 0, ErrNameTooLong
+		}
+
+		labelStart := position + 1
+		labelEnd := labelStart + int(lengthOfLabel)
+		if labelEnd > len(fullMessage) {
+			return "", 0, ErrNameOutOfBounds
+		}
+
+		parts = append(parts, string(fullMessage[labelStart:labelEnd]))
+		position = labelEnd
+	}
 
-		parts = append(parts, string(labelBytes))
-		hadRealLabelBefore = true
+	if !jumped {
+		nextOffset = position
 	}
 
-	label = strings.Join(parts, ".")
+	name = strings.Join(parts, ".")
 	return
 }
 
-func readCompressed(buffer *bytes.Buffer, fullMessage []byte) (part string) {
-	twoOctets := make([]byte, 2)
-	_, _ = buffer.Read(twoOctets)
+// IsSubdomain tells if name is equal to zone or is below it, names are compared case-insensitively.
+// Empty zone is the root and contains every name.
+func IsSubdomain(name, zone string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
 
-	readerTwoOctets := bytes.NewReader(twoOctets)
-	var indicatorAndOffset uint16
-
-	_ = binary.Read(readerTwoOctets, binary.BigEndian, &indicatorAndOffset)
+	if zone == "" || name == zone {
+		return true
+	}
+	return strings.HasSuffix(name, "."+zone)
+}
 
-	offset := (indicatorAndOffset << 2) >> 2
+// ParentName returns name without its first label, parent of a top level name is the root ""
+func ParentName(name string) string {
+	name = strings.TrimSuffix(name, ".")
 
-	updatedBuffer := bytes.NewBuffer(fullMessage[offset:])
-	part, _ = ReadLabel(updatedBuffer, fullMessage)
-	return
+	dot := strings.IndexByte(name, '.')
+	if dot == -1 {
+		return ""
+	}
+	return name[dot+1:]
 }
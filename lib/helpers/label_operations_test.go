@@ -0,0 +1,73 @@
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// pointerChain returns message with name "a" at offset 0 followed by pointers,
+// each of them to the one before it, and offset of the last pointer
+func pointerChain(pointers int) (message []byte, last int) {
+	message = []byte{1, 'a', 0}
+	previous := 0
+	for i := 0; i < pointers; i++ {
+		last = len(message)
+		message = append(message, 0xC0|byte(previous>>8), byte(previous))
+		previous = last
+	}
+	return
+}
+
+func TestReadNameLimitsPointers(t *testing.T) {
+	message, last := pointerChain(MaxCompressionPointers)
+	name, nextOffset, err := ReadName(message, last)
+	if err != nil || name != "a" || nextOffset != last+2 {
+		t.Errorf("chain of %d pointers: got %q %d %v, want \"a\" %d", MaxCompressionPointers, name, nextOffset, err, last+2)
+	}
+
+	message, last = pointerChain(MaxCompressionPointers + 1)
+	if _, _, err = ReadName(message, last); !errors.Is(err, ErrTooManyPointers) {
+		t.Errorf("chain of %d pointers: got %v, want %v", MaxCompressionPointers+1, err, ErrTooManyPointers)
+	}
+}
+
+func TestReadNameRejectsBadPointers(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+		offset  int
+		err     error
+	}{
+		{"pointer to itself", []byte{0xC0, 0x00}, 0, ErrPointerLoop},
+		{"forward pointer", []byte{0xC0, 0x02, 0x00}, 0, ErrForwardPointer},
+		{"loop", []byte{1, 'a', 0xC0, 0x00}, 0, ErrPointerLoop},
+		{"truncated pointer", []byte{0xC0}, 0, ErrNameOutOfBounds},
+		{"truncated label", []byte{5, 'a'}, 0, ErrNameOutOfBounds},
+		{"reserved label type", []byte{0x40, 0x00}, 0, ErrLabelTooLong},
+	}
+
+	for _, test := range tests {
+		if _, _, err := ReadName(test.message, test.offset); !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestWriteCompressedLabelRoundTrip(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	positions := make(map[string]int)
+	WriteCompressedLabel(buffer, "www.example.com", positions)
+	second := buffer.Len()
+	WriteCompressedLabel(buffer, "mail.example.com", positions)
+
+	for offset, want := range map[int]string{0: "www.example.com", second: "mail.example.com"} {
+		name, _, err := ReadName(buffer.Bytes(), offset)
+		if err != nil || name != want {
+			t.Errorf("offset %d: got %q %v, want %q", offset, name, err, want)
+		}
+	}
+	if buffer.Len() != second+1+4+2 {
+		t.Errorf("second name takes %d octets, want 7", buffer.Len()-second)
+	}
+}
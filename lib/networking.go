@@ -1,13 +1,24 @@
 package lib
 
 import (
-	"bytes"
+	"DNSServer/lib/structures"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"time"
 )
 
+const maxTCPMessageSize = 65535
+
+// tryToRetrieveDNSDataFromServers sends query to servers until one of them
+// answers, every exchange gets a new random message id
 func tryToRetrieveDNSDataFromServers(
-	message []byte,
+	ctx context.Context,
+	query *structures.DNSMessage,
 	attemptCountForOne int,
 	dialType string,
 	servers ...string) (
@@ -19,18 +30,54 @@ func tryToRetrieveDNSDataFromServers(
 	log.Println(len(servers))
 	for _, server := range servers {
 		currentAttempt := 1
+		caseMismatched := false
 
 		for currentAttempt <= attemptCountForOne {
+			if ctx.Err() != nil {
+				log.Printf("stopped asking servers: %s", ctx.Err())
+				return "", nil, false
+			}
+
+			if err := budgetFromContext(ctx).spendQuery(); err != nil {
+				log.Printf("stopped asking servers: %s", err)
+				return "", nil, false
+			}
+
 			log.Printf("making %s call to server %s", dialType, server)
 
-			data, err := makeNetDNSCall(server, dialType, message)
+			exchangeQuery := query.Copy()
+			exchangeQuery.Header.Id = structures.NewMessageID()
+
+			caseRandomised := CaseRandomisation && !caseMismatched && ServersRTT.CaseRandomisationAllowed(server)
+			if caseRandomised {
+				exchangeQuery.Questions = randomiseCase(query.Questions)
+			}
+
+			startedAt := time.Now()
+			data, err := makeNetDNSCall(ctx, server, dialType, exchangeQuery, caseRandomised)
+			if errors.Is(err, errCaseMismatch) {
+				// the server seems alive but not preserving case, so the attempt is repeated without 0x20,
+				// the new exchange has a new id which has to be guessed again
+				log.Printf("server %s has not echoed case of names, asking it without 0x20", server)
+				ServersRTT.RecordCaseMismatch(server)
+				caseMismatched = true
+				continue
+			}
 			if err != nil {
 				log.Printf("error %s while trying to make %s call for server %s, attempt %d",
 					err, dialType, server, currentAttempt)
+				// server is not to blame when we have cancelled the exchange ourselves
+				if ctx.Err() == nil {
+					ServersRTT.RecordFailure(server)
+				}
 				currentAttempt += 1
 				continue
 			}
 
+			ServersRTT.RecordSuccess(server, time.Since(startedAt))
+			if caseRandomised {
+				ServersRTT.RecordCasePreserved(server)
+			}
 			log.Printf("succeded making %s call to server %s", dialType, server)
 			return server, data, true
 		}
@@ -39,47 +86,130 @@ func tryToRetrieveDNSDataFromServers(
 	return "", nil, false
 }
 
-func makeNetDNSCall(ipAddressWithoutPort, dialType string, message []byte) (buffer []byte, err error) {
-	ipAddressWithCorrectPort := ipAddressWithoutPort + ":53"
+// makeNetDNSCall makes one exchange with the server, it takes at most
+// UpstreamTimeout and is cut earlier if ctx is done. Every exchange uses its
+// own socket, so it gets a fresh source port randomised by the system.
+// Responses which do not match the query are dropped, over udp the valid
+// response is awaited until the deadline. When exactCase is set, responses
+// which differ only in letter case are dropped as well and errCaseMismatch is
+// returned if nothing better has come until the deadline.
+func makeNetDNSCall(ctx context.Context, ipAddressWithoutPort, dialType string, query *structures.DNSMessage,
+	exactCase bool) (buffer []byte, err error) {
+	message := query.Marshal()
+	// ipv6 literals have to be in brackets before the port
+	ipAddressWithCorrectPort := net.JoinHostPort(ipAddressWithoutPort, "53")
+
+	exchangeCtx, cancel := context.WithTimeout(ctx, UpstreamTimeout)
+	defer cancel()
 
 	log.Printf("making %s call to %s", dialType, ipAddressWithCorrectPort)
-	conn, err := net.Dial(dialType, ipAddressWithCorrectPort)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(exchangeCtx, dialType, ipAddressWithCorrectPort)
 
 	if err != nil {
 		log.Printf("error while making %s call to %s, error %s", dialType, ipAddressWithCorrectPort, err)
 		return
 	}
 
-	if err != nil {
-		log.Fatalf("%s", err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	deadline, _ := exchangeCtx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	// deadline does not know about cancellation of ctx, so blocked read is interrupted here
+	exchangeDone := make(chan struct{})
+	defer close(exchangeDone)
+	go func() {
+		select {
+		case <-exchangeCtx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-exchangeDone:
+		}
+	}()
+
+	if dialType == "tcp" {
+		err = writeTCPMessage(conn, message)
+		if err != nil {
+			log.Printf("error while writing as %s to %s, error %s", dialType, ipAddressWithCorrectPort, err)
+			return
+		}
+
+		buffer, err = readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+
+		// nobody else could write into our tcp connection, mismatch is not worth waiting for more
+		if err = checkResponse(query, buffer, exactCase); err != nil {
+			if !errors.Is(err, errCaseMismatch) {
+				countSpoofedResponse(ipAddressWithoutPort, err)
+			}
+			return nil, err
+		}
+		return
 	}
+
 	_, err = conn.Write(message)
 	if err != nil {
 		log.Printf("error while writing as %s to %s, error %s", dialType, ipAddressWithCorrectPort, err)
 		return
 	}
 
-	if dialType == "udp" {
-		buffer = make([]byte, 1024)
-		_, err = conn.Read(buffer)
-	} else {
-		tcpBuffer := bytes.NewBuffer(make([]byte, 1024))
-		n := 1025
-		totalLength := 0
-		for n >= 1024 {
-			tempBuff := make([]byte, 1024)
-			n, err = conn.Read(tempBuff)
-			tcpBuffer.Write(tempBuff)
-			totalLength += n
-			tcpBuffer.Grow(1024)
+	// we have advertised EDNSBufferSize, so upstream answer could be that big
+	buffer = make([]byte, maxUDPMessageSize)
+	caseMismatched := false
+	for {
+		var n int
+		n, err = conn.Read(buffer)
+		if err != nil {
+			if caseMismatched {
+				return nil, fmt.Errorf("%w: no response with the exact case before %s", errCaseMismatch, err)
+			}
+			return nil, err
+		}
+
+		// anybody who has guessed the id is able to send case mismatch, so the real answer is still awaited
+		err = checkResponse(query, buffer[:n], exactCase)
+		if err != nil {
+			countSpoofedResponse(ipAddressWithoutPort, err)
+			caseMismatched = caseMismatched || errors.Is(err, errCaseMismatch)
+			continue
 		}
-		buffer = make([]byte, totalLength)
-		_, _ = tcpBuffer.Read(buffer)
+
+		// the buffer is as big as the biggest message, answer gets only as much memory as it needs
+		return append([]byte(nil), buffer[:n]...), nil
 	}
+}
 
-	defer func() {
-		_ = conn.Close()
-	}()
+// readTCPMessage reads one message prefixed with its two byte length
+// https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.2
+func readTCPMessage(conn io.Reader) (message []byte, err error) {
+	lengthPrefix := make([]byte, 2)
+	if _, err = io.ReadFull(conn, lengthPrefix); err != nil {
+		return
+	}
 
+	message = make([]byte, binary.BigEndian.Uint16(lengthPrefix))
+	_, err = io.ReadFull(conn, message)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	return
 }
+
+// writeTCPMessage writes message prefixed with its two byte length in one write,
+// so it is not split in separate segments
+func writeTCPMessage(conn net.Conn, message []byte) error {
+	if len(message) > maxTCPMessageSize {
+		return fmt.Errorf("message of %d bytes is too big for tcp", len(message))
+	}
+
+	framed := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(framed, uint16(len(message)))
+	copy(framed[2:], message)
+
+	_, err := conn.Write(framed)
+	return err
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"DNSServer/lib/structures"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// QNAMEMinimisationMode tells how much of the name is sent to servers
+// of the zones above it https://datatracker.ietf.org/doc/html/rfc9156
+type QNAMEMinimisationMode int
+
+const (
+	// QNAMEMinimisationOff sends the full question to every server
+	QNAMEMinimisationOff QNAMEMinimisationMode = iota
+
+	// QNAMEMinimisationStrict trusts NXDOMAIN for the minimised name and
+	// fails when servers fail to answer the minimised query
+	QNAMEMinimisationStrict
+
+	// QNAMEMinimisationRelaxed asks the full question when servers answer
+	// the minimised query with NXDOMAIN (broken empty non-terminals) or fail
+	QNAMEMinimisationRelaxed
+)
+
+// Limits of minimised queries for names with many labels
+// https://datatracker.ietf.org/doc/html/rfc9156#section-2.3
+const (
+	maxMinimiseCount = 10
+	minimiseOneLabel = 4
+)
+
+func ParseQNAMEMinimisationMode(mode string) (QNAMEMinimisationMode, error) {
+	switch mode {
+	case "off":
+		return QNAMEMinimisationOff, nil
+	case "strict":
+		return QNAMEMinimisationStrict, nil
+	case "relaxed":
+		return QNAMEMinimisationRelaxed, nil
+	}
+	return 0, fmt.Errorf("unknown qname minimisation mode %q, expected off, strict or relaxed", mode)
+}
+
+// zoneAsker sends query to servers of one zone
+type zoneAsker func(ctx context.Context, query *structures.DNSMessage) (responseKind, *structures.DNSMessage, error)
+
+// askMinimised asks servers of zone for the question of queryMessage, revealing
+// one more label of the name with every query until servers answer with a
+// referral or the full name is reached
+func askMinimised(ctx context.Context, queryMessage *structures.DNSMessage, zone string, ask zoneAsker) (
+	kind responseKind, lastReceivedMsg *structures.DNSMessage, err error) {
+	question := queryMessage.Questions[0]
+	labels := strings.Split(strings.TrimSuffix(question.QName, "."), ".")
+	labelsCount := countLabels(zone)
+	ask = inBailiwickOf(zone, ask)
+
+	if QNAMEMinimisation == QNAMEMinimisationOff || question.QName == "" {
+		return ask(ctx, queryMessage)
+	}
+
+	for minimiseCount := 0; ; minimiseCount++ {
+		labelsLeft := len(labels) - labelsCount
+		if labelsLeft <= 1 || minimiseCount >= maxMinimiseCount {
+			return ask(ctx, queryMessage)
+		}
+
+		if minimiseCount < minimiseOneLabel {
+			labelsCount += 1
+		} else {
+			labelsCount += (labelsLeft + maxMinimiseCount - minimiseCount - 1) / (maxMinimiseCount - minimiseCount)
+		}
+		if labelsCount >= len(labels) {
+			return ask(ctx, queryMessage)
+		}
+
+		// https://datatracker.ietf.org/doc/html/rfc9156#section-2.1
+		// type A is used, because some servers answer badly to NS queries
+		minimisedName := strings.Join(labels[len(labels)-labelsCount:], ".")
+		minimisedQuestion := structures.NewDNSQuestion(minimisedName, structures.QTypeA, structures.QClassIN)
+		log.Printf("asking zone %q for minimised name %s instead of %s", zone, minimisedName, question.QName)
+
+		kind, lastReceivedMsg, err = ask(ctx, structures.NewQueryDNSMessage(minimisedQuestion))
+		if err != nil {
+			if QNAMEMinimisation == QNAMEMinimisationRelaxed && ctx.Err() == nil && !budgetFromContext(ctx).exhausted() {
+				log.Printf("minimised query for %s has failed, asking full name: %s", minimisedName, err)
+				return ask(ctx, queryMessage)
+			}
+			return
+		}
+
+		switch kind {
+		case responseReferral:
+			return
+		case responseNameError:
+			if QNAMEMinimisation == QNAMEMinimisationRelaxed {
+				log.Printf("%s does not exist, asking full name in case it is a broken empty non-terminal", minimisedName)
+				return ask(ctx, queryMessage)
+			}
+
+			// https://datatracker.ietf.org/doc/html/rfc8020
+			// nothing exists below the name which does not exist
+			lastReceivedMsg.Questions = queryMessage.Questions
+			lastReceivedMsg.Answer = nil
+			return
+		}
+
+		// answer or NODATA, the name is not a zone cut and servers of the
+		// same zone are asked again with one more label
+	}
+}
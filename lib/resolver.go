@@ -1,40 +1,225 @@
 package lib
 
 import (
+	"DNSServer/lib/helpers"
 	"DNSServer/lib/structures"
+	"context"
+	"errors"
+	"fmt"
 	"log"
-	"net"
+	"strings"
 	"sync"
 )
 
-var sendMutex sync.Mutex
-var cache = structures.NewQueryCache()
+var cache = structures.NewQueryCache(MaxCacheEntries, MaxCacheBytes)
 
-func Resolve(incomingRequest *IncomingRequest, conn net.PacketConn) {
-	// dig sends weird (name Root, type OPT) stuff, so I ignore it
-	incomingRequest.DNSMessage.Header.ARCOUNT = 0
-	incomingRequest.DNSMessage.Additional = nil
+var delegations = structures.NewDelegationCache(MaxDelegationEntries)
 
-	answer := resolveQueryDNS(incomingRequest.DNSMessage)
+var (
+	errAllServersFailed = errors.New("failed to receive dns data from all servers")
+	errNoNameservers    = errors.New("referral has no nameservers to follow")
+)
+
+// ResolutionError is a failure which is reported to the client with RCode,
+// errors of other types are reported as SERVFAIL.
+type ResolutionError struct {
+	RCode byte
+	Err   error
+}
+
+func (e *ResolutionError) Error() string {
+	return fmt.Sprintf("rcode %d: %s", e.RCode, e.Err)
+}
+
+func (e *ResolutionError) Unwrap() error {
+	return e.Err
+}
+
+// rcodeForError picks response code the client gets when resolution has failed with err
+func rcodeForError(err error) byte {
+	var resolutionError *ResolutionError
+	if errors.As(err, &resolutionError) {
+		return resolutionError.RCode
+	}
+	return structures.RCodeServerFailure
+}
+
+func Resolve(incomingRequest *IncomingRequest) {
+	query := incomingRequest.DNSMessage
+
+	defer func() {
+		// one broken resolution must not take the whole server down
+		if err := recover(); err != nil {
+			log.Printf("caught panic while resolving %s: %s", query.Questions[0].QName, err)
+			answer := structures.NewErrorAnswerDNSMessage(query.Questions, structures.RCodeServerFailure)
+			writeAnswer(answer, incomingRequest, nil)
+		}
+	}()
+
+	clientEDNS, err := query.EDNS()
+	if err != nil {
+		log.Printf("bad OPT in request from %s: %s", incomingRequest.Address, err)
+		answer := structures.NewErrorAnswerDNSMessage(query.Questions, structures.RCodeFormatError)
+		writeAnswer(answer, incomingRequest, nil)
+		return
+	}
+
+	if clientEDNS != nil && clientEDNS.Version > structures.EDNSVersion {
+		// https://datatracker.ietf.org/doc/html/rfc6891#section-6.1.3
+		// responder MUST respond with RCODE=BADVERS and version it implements
+		log.Printf("unsupported EDNS version %d from %s", clientEDNS.Version, incomingRequest.Address)
+		answer := structures.NewErrorAnswerDNSMessage(query.Questions, structures.RCodeBadVersion)
+		writeAnswer(answer, incomingRequest, clientEDNS)
+		return
+	}
+
+	// our own OPT is sent upstream, client's one is answered in writeAnswer
+	query.SetEDNS(nil)
+
+	// whole resolution of one client query, with all referrals and
+	// glueless nameservers lookups, has to fit into QueryTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+	ctx = withResolutionBudget(ctx)
+
+	// identical queries of other clients which arrive meanwhile wait for this resolution
+	answer, err := Coalescer.Resolve(ctx, query, resolveQueryDNS)
+	if err != nil {
+		log.Printf("failed to resolve %s: %s", query.Questions[0].QName, err)
+		answer = structures.NewErrorAnswerDNSMessage(query.Questions, rcodeForError(err))
+	}
+
+	writeAnswer(answer, incomingRequest, clientEDNS)
+}
+
+// writeAnswer makes answer look like it is ours, adds OPT if the client
+// has sent one and sends it to the client. Answers over udp are truncated
+// to the client's payload size.
+func writeAnswer(answer *structures.DNSMessage, incomingRequest *IncomingRequest, clientEDNS *structures.EDNS) {
 	makeAnswerLookLikeThisDNSServerSendIt(answer, incomingRequest.DNSMessage)
 
-	sendMutex.Lock()
-	_, _ = conn.WriteTo(answer.Marshal(), incomingRequest.Address)
-	sendMutex.Unlock()
+	// upstream OPT is about upstream transport, it must not be passed to the client
+	answer.SetEDNS(nil)
+
+	var edns *structures.EDNS
+	maxSize := structures.MinUDPPayloadSize
+	if clientEDNS != nil {
+		edns = structures.NewEDNS(EDNSBufferSize)
+		edns.ExtendedRCODE = answer.Header.RCODE >> 4
+		answer.SetEDNS(edns)
+
+		maxSize = clientEDNS.PayloadSize()
+		if ownSize := edns.PayloadSize(); ownSize < maxSize {
+			maxSize = ownSize
+		}
+	}
+	if incomingRequest.Network == "tcp" {
+		maxSize = maxTCPMessageSize
+	}
+	// extended bits are carried in OPT only
+	answer.Header.RCODE &= 0xF
+
+	data := answer.Marshal()
+	if len(data) > maxSize {
+		log.Printf("answer of %d bytes does not fit into %d, truncating", len(data), maxSize)
+		answer.Header.TC = 1
+		answer.Answer = nil
+		answer.Authority = nil
+		answer.Additional = nil
+		answer.SetEDNS(edns)
+		data = answer.Marshal()
+	}
+
+	incomingRequest.respond(data)
 }
 
-func resolveQueryDNS(queryMessage *structures.DNSMessage) *structures.DNSMessage {
+func resolveQueryDNS(ctx context.Context, queryMessage *structures.DNSMessage) (*structures.DNSMessage, error) {
+	question := queryMessage.Questions[0]
+	if question.QClass != structures.QClassIN {
+		return nil, &ResolutionError{
+			RCode: structures.RCodeRefused,
+			Err:   fmt.Errorf("class %d is not supported", question.QClass),
+		}
+	}
+	if question.QType == structures.QTypeAXFR || question.QType == structures.QTypeMAILA ||
+		question.QType == structures.QTypeMAILB {
+		return nil, &ResolutionError{
+			RCode: structures.RCodeRefused,
+			Err:   fmt.Errorf("type %d is not supported by recursive resolver", question.QType),
+		}
+	}
+
+	return resolveFollowingCNAMEs(ctx, queryMessage)
+}
+
+// resolveQuestion resolves the question of queryMessage as is, from cache or
+// by iteration from the root. CNAMEs in the answer are not followed here.
+func resolveQuestion(ctx context.Context, queryMessage *structures.DNSMessage) (*structures.DNSMessage, error) {
+	question := queryMessage.Questions[0]
+
 	answers, cacheFound := askCache(queryMessage)
 	log.Printf("asked cache? %t", cacheFound)
 	if cacheFound {
-		return structures.NewAnswerDNSMessage(queryMessage.Questions, answers)
+		return structures.NewAnswerDNSMessage(queryMessage.Questions, answers), nil
+	}
+
+	if rcode, soa, found := cache.GetNegative(question); found {
+		log.Printf("found negative answer with rcode %d in cache", rcode)
+		answer := structures.NewErrorAnswerDNSMessage(queryMessage.Questions, rcode)
+		answer.Authority = []*structures.DNSRecord{soa}
+		return answer, nil
+	}
+
+	if zone, forwarders, found := forwardersFor(question.QName); found {
+		log.Printf("forwarding %s to servers of zone %q", question.QName, zone)
+		kind, lastMessage, err := forwardQuery(ctx, queryMessage, zone, forwarders...)
+		if err != nil {
+			return nil, err
+		}
+		return cacheAnswer(queryMessage, kind, lastMessage), nil
+	}
+
+	kind, lastMessage, currentZone, err := askClosestServers(ctx, queryMessage)
+
+	for err == nil && kind == responseReferral {
+		// depth is limited for the whole client query, not for every name resolved for it
+		if err = budgetFromContext(ctx).spendReferral(); err != nil {
+			break
+		}
+
+		// every referral has to be to a zone below the one we have asked,
+		// otherwise servers could send us in circles
+		zone := referralZone(lastMessage)
+		if strings.EqualFold(zone, currentZone) || !helpers.IsSubdomain(zone, currentZone) {
+			err = fmt.Errorf("%w: from zone %q to %q", errReferralLoop, currentZone, zone)
+			break
+		}
+		currentZone = zone
+		delegations.SetDelegation(zone, lastMessage.Authority, lastMessage.Additional)
+
+		referral := lastMessage
+		kind, lastMessage, err = askMinimised(ctx, queryMessage, zone,
+			func(ctx context.Context, query *structures.DNSMessage) (responseKind, *structures.DNSMessage, error) {
+				return askReferral(ctx, query, referral)
+			})
+	}
+
+	if err != nil {
+		return nil, err
 	}
 
-	foundAnswer, lastMessage := askDNS(queryMessage, RootIPServers...)
+	return cacheAnswer(queryMessage, kind, lastMessage), nil
+}
 
-	for !foundAnswer {
-		nextServersToAsk := collectNamespaceIp(lastMessage)
-		foundAnswer, lastMessage = askDNS(queryMessage, nextServersToAsk...)
+// cacheAnswer stores final answer of kind for the question of queryMessage
+func cacheAnswer(queryMessage *structures.DNSMessage, kind responseKind, lastMessage *structures.DNSMessage) *structures.DNSMessage {
+	if kind == responseNameError || kind == responseNoData {
+		if len(lastMessage.Answer) != 0 {
+			// CNAMEs leading to the name which does not exist are still true
+			setCache(queryMessage, lastMessage)
+		}
+		setNegativeCache(queryMessage, lastMessage)
+		return lastMessage
 	}
 
 	log.Println("adding cache")
@@ -42,6 +227,37 @@ func resolveQueryDNS(queryMessage *structures.DNSMessage) *structures.DNSMessage
 	return lastMessage
 }
 
+// askClosestServers asks servers of the closest zone enclosing the question
+// whose delegation is cached, or root servers when there is none or when
+// servers of the cached zone have failed
+func askClosestServers(ctx context.Context, queryMessage *structures.DNSMessage) (
+	kind responseKind, lastMessage *structures.DNSMessage, zone string, err error) {
+	zone, nameservers, addresses, found := delegations.ClosestDelegation(queryMessage.Questions[0].QName)
+	if found {
+		log.Printf("starting from cached delegation of %q", zone)
+		cachedReferral := structures.NewDNSMessage(structures.NewDNSAnswerHeader(), queryMessage.Questions,
+			nil, nameservers, addresses)
+
+		kind, lastMessage, err = askMinimised(ctx, queryMessage, zone,
+			func(ctx context.Context, query *structures.DNSMessage) (responseKind, *structures.DNSMessage, error) {
+				return askReferral(ctx, query, cachedReferral)
+			})
+		if err == nil || ctx.Err() != nil || budgetFromContext(ctx).exhausted() {
+			return
+		}
+		log.Printf("servers of cached zone %q have failed, starting from the root: %s", zone, err)
+	}
+
+	// root servers are asked first
+	zone = ""
+	roots := rootServers()
+	kind, lastMessage, err = askMinimised(ctx, queryMessage, zone,
+		func(ctx context.Context, query *structures.DNSMessage) (responseKind, *structures.DNSMessage, error) {
+			return askDNS(ctx, query, roots...)
+		})
+	return
+}
+
 func askCache(queryMessage *structures.DNSMessage) ([]*structures.DNSRecord, bool) {
 	question := queryMessage.Questions[0]
 	return cache.Get(question)
@@ -49,119 +265,405 @@ func askCache(queryMessage *structures.DNSMessage) ([]*structures.DNSRecord, boo
 
 func setCache(originalMessage *structures.DNSMessage, answerMessage *structures.DNSMessage) {
 	question := originalMessage.Questions[0]
-	cache.Set(question, answerMessage.Answer)
+	cache.Set(question, answerMessage.Answer, structures.AnswerCredibility(answerMessage))
 }
 
-func askDNS(queryMessage *structures.DNSMessage, serversToAsk ...string) (
-	foundAnswers bool, lastReceivedMsg *structures.DNSMessage) {
-	marshaledIncomingRequest := queryMessage.Marshal()
+// setNegativeCache stores NXDOMAIN or NODATA answer, answers without SOA are not cached
+// https://datatracker.ietf.org/doc/html/rfc2308#section-5
+// When answer has CNAMEs, the negative answer is about the end of their chain.
+func setNegativeCache(originalMessage *structures.DNSMessage, answerMessage *structures.DNSMessage) {
+	question := originalMessage.Questions[0]
+	if chain, _, target := followCNAMEs(answerMessage.Answer, question); len(chain) != 0 {
+		question = structures.NewDNSQuestion(target, question.QType, question.QClass)
+	}
 
-	_, ans, succeeded := tryToRetrieveDNSDataFromServers(marshaledIncomingRequest, 1, "udp", serversToAsk...)
-	if !succeeded {
-		log.Fatalf("Failed to receive dns data from all servers")
+	for _, record := range answerMessage.Authority {
+		if record.Type == structures.RecordTypeSOA && record.Data != nil {
+			log.Printf("adding negative cache for %s with ttl %d", question.QName, structures.NegativeTTL(record))
+			cache.SetNegative(question, answerMessage.Header.RCODE, record)
+			return
+		}
 	}
 
-	lastReceivedMsg, err := structures.UnmarshalMessage(ans)
-	if err != nil {
-		log.Fatalf("error while unmarshallind root answer err = %s", err)
+	log.Printf("negative answer for %s has no SOA, not caching it", question.QName)
+}
+
+// responseKind tells what upstream has answered, see
+// https://datatracker.ietf.org/doc/html/rfc2308#section-2
+type responseKind int
+
+const (
+	responseAnswer    responseKind = iota // answer section has data for the question
+	responseReferral                      // delegation to the servers of a closer zone
+	responseNameError                     // NXDOMAIN, the name does not exist
+	responseNoData                        // the name exists, but has no records of the type
+)
+
+func classifyResponse(response *structures.DNSMessage) responseKind {
+	if response.Header.RCODE == structures.RCodeNameError {
+		return responseNameError
 	}
 
-	// for some reason, dns servers declined to use tcp..
-	// i always got EOF while making requests over tcp
+	if len(response.Answer) > 0 {
+		return responseAnswer
+	}
+
+	// referrals never come with AA set, so authoritative empty answer is NODATA
+	// even when it lists NS of the zone itself instead of its SOA
+	if response.Header.AA == 1 {
+		return responseNoData
+	}
+
+	// non-authoritative NODATA carries SOA of the zone
+	for _, record := range response.Authority {
+		if record.Type == structures.RecordTypeSOA {
+			return responseNoData
+		}
+	}
 
-	//if msg.Header.TC == 1 {
-	//	log.Println("message is to big, have to make TCP call")
-	//	retrievedFrom, data, succeeded := tryToRetrieveDNSDataFromServers(marshaledIncomingRequest, 1, "tcp", serversToAsk...)
-	//
-	//	if !succeeded {
-	//		log.Fatalf("didnt succeed with retrieving data")
-	//	}
-	//
-	//	log.Printf("retrieved from %s", retrievedFrom)
-	//	msg, _ = structures.UnmarshalMessage(data)
-	//}
+	return responseReferral
+}
 
-	if lastReceivedMsg.Header.ANCOUNT >= queryMessage.Header.QDCOUNT {
+// askDNS asks servers iteratively (without recursion desired) for the question of queryMessage
+func askDNS(ctx context.Context, queryMessage *structures.DNSMessage, serversToAsk ...string) (
+	kind responseKind, lastReceivedMsg *structures.DNSMessage, err error) {
+	upstreamQuery := structures.NewQueryDNSMessage(queryMessage.Questions...)
+	return askServers(ctx, upstreamQuery, serversToAsk...)
+}
+
+// askServers sends upstreamQuery to servers one by one until one of them gives a usable answer,
+// servers which fail or answer with an error or an empty referral are skipped.
+func askServers(ctx context.Context, upstreamQuery *structures.DNSMessage, serversToAsk ...string) (
+	kind responseKind, lastReceivedMsg *structures.DNSMessage, err error) {
+	question := upstreamQuery.Questions[0]
+	upstreamQuery.SetEDNS(structures.NewEDNS(EDNSBufferSize))
+
+	err = errAllServersFailed
+	for _, server := range ServersRTT.Order(allowedAddresses(serversToAsk)) {
+		kind, lastReceivedMsg, err = askServer(ctx, upstreamQuery, server)
+		if err == nil {
+			break
+		}
+
+		log.Printf("server %s has not answered %s: %s", server, question.QName, err)
+		if budgetFromContext(ctx).exhausted() {
+			return kind, nil, errBudgetExhausted
+		}
+		if ctx.Err() != nil {
+			return kind, nil, ctx.Err()
+		}
+	}
+
+	if err != nil {
+		return
+	}
+
+	switch kind {
+	case responseAnswer:
 		log.Println("found full answer count for incoming questions count")
-		foundAnswers = true
+	case responseReferral:
+		log.Printf("answer count %d is lower than query message, following referral", lastReceivedMsg.Header.ANCOUNT)
+	case responseNameError:
+		log.Printf("%s does not exist", question.QName)
+	case responseNoData:
+		log.Printf("%s has no records of type %d", question.QName, question.QType)
+	}
+
+	return
+}
+
+// askServer makes the exchange with one server, over udp and then over tcp if the answer is truncated.
+// Server which does not understand EDNS is asked once more without OPT record
+// https://datatracker.ietf.org/doc/html/rfc6891#section-7
+func askServer(ctx context.Context, upstreamQuery *structures.DNSMessage, server string) (
+	kind responseKind, lastReceivedMsg *structures.DNSMessage, err error) {
+	retrievedFrom, lastReceivedMsg, err := exchangeWithServer(ctx, upstreamQuery, server)
+	if err != nil {
+		return
+	}
+
+	rcode := lastReceivedMsg.RCode()
+	if rcode == int(structures.RCodeFormatError) || rcode == int(structures.RCodeNotImplemented) {
+		if edns, _ := upstreamQuery.EDNS(); edns != nil {
+			log.Printf("server %s answered with rcode %d, asking it again without EDNS", retrievedFrom, rcode)
+
+			plainQuery := upstreamQuery.Copy()
+			plainQuery.SetEDNS(nil)
+			retrievedFrom, lastReceivedMsg, err = exchangeWithServer(ctx, plainQuery, server)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	switch rcode := lastReceivedMsg.RCode(); rcode {
+	case int(structures.RCodeNoError), int(structures.RCodeNameError):
+	default:
+		ServersRTT.RecordFailure(retrievedFrom)
+		err = fmt.Errorf("server %s answered with rcode %d", retrievedFrom, rcode)
+		return
+	}
+
+	kind = classifyResponse(lastReceivedMsg)
+	if kind == responseReferral && referralZone(lastReceivedMsg) == "" {
+		ServersRTT.RecordFailure(retrievedFrom)
+		err = fmt.Errorf("server %s is lame: %w", retrievedFrom, errNoNameservers)
 		return
 	}
 
-	log.Printf("answer count %d is lower than query message", lastReceivedMsg.Header.ANCOUNT)
-	foundAnswers = false
 	return
 }
 
-func collectNamespaceIp(fromMessage *structures.DNSMessage) (namespaceIp []string) {
-	nsWithIps := collectAllIPAuthorityNSFromAdditional(fromMessage)
+// exchangeWithServer sends query to the server over udp and then over tcp if the answer is truncated
+func exchangeWithServer(ctx context.Context, upstreamQuery *structures.DNSMessage, server string) (
+	retrievedFrom string, lastReceivedMsg *structures.DNSMessage, err error) {
+	retrievedFrom, ans, succeeded := tryToRetrieveDNSDataFromServers(ctx, upstreamQuery, UpstreamAttempts, "udp", server)
+	if !succeeded {
+		err = errAllServersFailed
+		return
+	}
+
+	lastReceivedMsg, err = structures.UnmarshalMessage(ans)
+	if err != nil {
+		err = fmt.Errorf("error while unmarshalling answer from %s: %w", retrievedFrom, err)
+		return
+	}
+	restoreQuestionCase(lastReceivedMsg, upstreamQuery)
+
+	if lastReceivedMsg.Header.TC == 1 {
+		log.Printf("answer from %s is truncated, have to make TCP call", retrievedFrom)
+
+		// server which has truncated the answer surely has the full one
+		retrievedFrom, ans, succeeded = tryToRetrieveDNSDataFromServers(ctx, upstreamQuery, UpstreamAttempts, "tcp", server)
+		if !succeeded {
+			err = fmt.Errorf("didnt succeed with retrieving data over tcp: %w", errAllServersFailed)
+			return
+		}
+
+		log.Printf("retrieved from %s over tcp", retrievedFrom)
+		lastReceivedMsg, err = structures.UnmarshalMessage(ans)
+		if err != nil {
+			err = fmt.Errorf("error while unmarshalling tcp answer from %s: %w", retrievedFrom, err)
+			return
+		}
+		restoreQuestionCase(lastReceivedMsg, upstreamQuery)
+	}
+
+	return
+}
 
-	var allNamespaces []string
-	for ns, ip := range nsWithIps {
-		allNamespaces = append(allNamespaces, ns)
+// askReferral asks servers of the zone the referral delegates to. Servers
+// with glue are asked first, then names of servers without glue are resolved
+// concurrently and whichever addresses are known first are asked.
+func askReferral(ctx context.Context, queryMessage, referral *structures.DNSMessage) (
+	kind responseKind, lastReceivedMsg *structures.DNSMessage, err error) {
+	gluedIps, gluelessNames := collectNamespaceIp(ctx, referral)
+	if len(gluedIps) == 0 && len(gluelessNames) == 0 {
+		return kind, nil, errNoNameservers
+	}
+
+	if len(gluedIps) != 0 {
+		kind, lastReceivedMsg, err = askDNS(ctx, queryMessage, gluedIps...)
+		if err == nil || len(gluelessNames) == 0 || budgetFromContext(ctx).exhausted() || ctx.Err() != nil {
+			return
+		}
+		log.Printf("servers with glue have failed, resolving %d nameservers without glue", len(gluelessNames))
+	}
+
+	// lookups which are still running are not needed after some server has answered
+	lookupCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		if len(ip) == 0 {
+	err = errNoNameservers
+	for lookup := range retrieveNameserversIps(lookupCtx, gluelessNames...) {
+		if lookup.err != nil {
+			log.Printf("failed to resolve nameserver %s: %s", lookup.name, lookup.err)
+			err = lookup.err
 			continue
 		}
 
-		log.Printf("adding new server name=%s, ip=%s to ask", ns, ip)
-		namespaceIp = append(namespaceIp, ip)
+		kind, lastReceivedMsg, err = askDNS(ctx, queryMessage, lookup.ips...)
+		if err == nil {
+			return
+		}
+	}
+
+	return
+}
+
+// collectNamespaceIp splits nameservers of the referral into addresses known
+// from glue and names which have to be resolved first. Nameservers with glue
+// only of the ip version which is not used are treated as glueless. Only
+// nameservers the budget of the client query allows are used.
+func collectNamespaceIp(ctx context.Context, fromMessage *structures.DNSMessage) (gluedIps []string, gluelessNames []string) {
+	nsWithIps := collectAllIPAuthorityNSFromAdditional(fromMessage)
+
+	names := make([]string, 0, len(nsWithIps))
+	for ns := range nsWithIps {
+		names = append(names, ns)
 	}
 
-	if namespaceIp == nil {
-		nsWithIps = retrieveNameserversIps(allNamespaces[0])
+	allowed := budgetFromContext(ctx).spendNameservers(names)
+	if len(allowed) < len(names) {
+		log.Printf("referral has %d nameservers, only %d are used", len(names), len(allowed))
+	}
 
-		for _, ip := range nsWithIps {
-			namespaceIp = append(namespaceIp, ip)
+	for _, ns := range allowed {
+		ips := allowedAddresses(nsWithIps[ns])
+		if len(ips) == 0 {
+			gluelessNames = append(gluelessNames, ns)
+			continue
 		}
+
+		log.Printf("adding new server name=%s, ips=%s to ask", ns, ips)
+		gluedIps = append(gluedIps, ips...)
 	}
 
 	return
 }
 
-func collectAllIPAuthorityNSFromAdditional(fromMessage *structures.DNSMessage) map[string]string {
-	nsNamesWithIps := make(map[string]string)
+// referralZone returns the zone which referral delegates to, it is the owner of NS records
+func referralZone(fromMessage *structures.DNSMessage) string {
+	for _, record := range fromMessage.Authority {
+		if record.Type == structures.RecordTypeNS {
+			return record.Name
+		}
+	}
+	return ""
+}
+
+func collectAllIPAuthorityNSFromAdditional(fromMessage *structures.DNSMessage) map[string][]string {
+	nsNamesWithIps := make(map[string][]string)
 
 	for _, authorityNsRecord := range fromMessage.Authority {
 		if authorityNsRecord.Type == structures.RecordTypeNS &&
 			authorityNsRecord.Class == structures.RecordClassIN {
-			nsNamesWithIps[authorityNsRecord.RDataRepresentation] = ""
+			nsNamesWithIps[authorityNsRecord.RDataRepresentation] = nil
 		}
 	}
 
 	for _, additionalRecord := range fromMessage.Additional {
-		if additionalRecord.Type == structures.RecordTypeA &&
+		if isAddressRecord(additionalRecord) &&
 			additionalRecord.Class == structures.RecordClassIN {
 
-			_, ok := nsNamesWithIps[additionalRecord.Name]
+			ips, ok := nsNamesWithIps[additionalRecord.Name]
 			if !ok {
 				continue
 			}
 
-			nsNamesWithIps[additionalRecord.Name] = additionalRecord.RDataRepresentation
+			nsNamesWithIps[additionalRecord.Name] = append(ips, additionalRecord.RDataRepresentation)
 		}
 	}
 
 	return nsNamesWithIps
 }
 
-func retrieveNameserversIps(nameserversToRetrieve ...string) map[string]string {
-	var nsNamesWithIps = make(map[string]string)
+// nameserverLookup is the result of resolving address of one nameserver
+type nameserverLookup struct {
+	name string
+	ips  []string
+	err  error
+}
 
-	for _, name := range nameserversToRetrieve {
+// retrieveNameserversIps resolves addresses of nameservers concurrently, at most
+// MaxParallelGluelessLookups at once. Results are sent as soon as they are ready,
+// the channel is closed when all lookups are done or ctx is cancelled.
+func retrieveNameserversIps(ctx context.Context, nameserversToRetrieve ...string) <-chan nameserverLookup {
+	results := make(chan nameserverLookup)
+	parallelSlots := make(chan struct{}, MaxParallelGluelessLookups)
+
+	go func() {
+		var lookups sync.WaitGroup
+		defer func() {
+			lookups.Wait()
+			close(results)
+		}()
+
+		for _, name := range nameserversToRetrieve {
+			select {
+			case parallelSlots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			lookups.Add(1)
+			go func(name string) {
+				defer lookups.Done()
+				defer func() { <-parallelSlots }()
+
+				var lookup nameserverLookup
+				func() {
+					// a panic in this goroutine can not be caught by Resolve,
+					// so it is returned as the lookup error instead
+					defer func() {
+						if recovered := recover(); recovered != nil {
+							log.Printf("caught panic while resolving nameserver %s: %v", name, recovered)
+							lookup = nameserverLookup{name: name, err: fmt.Errorf("nameserver lookup has panicked: %v", recovered)}
+						}
+					}()
+					lookup = retrieveNameserverIps(ctx, name)
+				}()
+
+				select {
+				case results <- lookup:
+				case <-ctx.Done():
+				}
+			}(name)
+		}
+	}()
+
+	return results
+}
+
+func retrieveNameserverIps(ctx context.Context, name string) nameserverLookup {
+	lookup := nameserverLookup{name: name}
+
+	for _, address := range delegations.Addresses(name) {
+		if isAllowedAddress(address.RDataRepresentation) {
+			lookup.ips = append(lookup.ips, address.RDataRepresentation)
+		}
+	}
+	if lookup.ips != nil {
+		log.Printf("found cached addresses of nameserver %s", name)
+		return lookup
+	}
+
+	if err := budgetFromContext(ctx).spendGlueless(); err != nil {
+		lookup.err = err
+		return lookup
+	}
+
+	// addresses of the other ip version are resolved only when there are none of the preferred one
+	for _, qtype := range addressQueryTypes() {
 		// https://stackoverflow.com/a/4083071
 		// "No one support multiply questions in DNS Message today"
-
-		currentQuestion := structures.NewDNSQuestion(name, structures.QTypeA, structures.QClassIN)
+		currentQuestion := structures.NewDNSQuestion(name, qtype, structures.QClassIN)
 		message := structures.NewQueryDNSMessage(currentQuestion)
 
-		answerMessage := resolveQueryDNS(message)
+		answerMessage, err := resolveQueryDNS(ctx, message)
+		if err != nil {
+			lookup.err = fmt.Errorf("error while resolving nameserver %s: %w", name, err)
+			continue
+		}
 
+		delegations.SetAddresses(name, answerMessage.Answer, structures.AnswerCredibility(answerMessage))
 		for _, answer := range answerMessage.Answer {
-			nsNamesWithIps[answer.Name] = answer.RDataRepresentation
+			if answer.Type == structures.RecordType(qtype) {
+				lookup.ips = append(lookup.ips, answer.RDataRepresentation)
+			}
+		}
+
+		if lookup.ips != nil {
+			lookup.err = nil
+			return lookup
 		}
 	}
 
-	return nsNamesWithIps
+	if lookup.err == nil {
+		lookup.err = fmt.Errorf("nameserver %s has no addresses", name)
+	}
+
+	return lookup
 }
 
 func makeAnswerLookLikeThisDNSServerSendIt(answer *structures.DNSMessage,
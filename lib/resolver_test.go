@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"DNSServer/lib/structures"
+	"net"
+	"testing"
+)
+
+func TestClassifyResponse(t *testing.T) {
+	ns := structures.NewDNSRecord("example.com", structures.RecordClassIN, 3600, &structures.NS{Host: "ns1.example.com"})
+	soa := structures.NewDNSRecord("example.com", structures.RecordClassIN, 3600, &structures.SOA{MName: "ns1.example.com"})
+	a := structures.NewDNSRecord("www.example.com", structures.RecordClassIN, 60, &structures.A{Address: net.ParseIP("192.0.2.1").To4()})
+
+	response := func(rcode, aa byte, answer, authority []*structures.DNSRecord) *structures.DNSMessage {
+		message := structures.NewDNSMessage(structures.NewDNSAnswerHeader(), nil, answer, authority, nil)
+		message.Header.RCODE = rcode
+		message.Header.AA = aa
+		return message
+	}
+
+	tests := []struct {
+		name     string
+		response *structures.DNSMessage
+		want     responseKind
+	}{
+		{"answer", response(0, 1, []*structures.DNSRecord{a}, nil), responseAnswer},
+		{"name error", response(structures.RCodeNameError, 1, nil, []*structures.DNSRecord{soa}), responseNameError},
+		{"nodata with soa", response(0, 0, nil, []*structures.DNSRecord{soa}), responseNoData},
+		{"authoritative nodata without authority", response(0, 1, nil, nil), responseNoData},
+		{"authoritative nodata with own ns", response(0, 1, nil, []*structures.DNSRecord{ns}), responseNoData},
+		{"referral", response(0, 0, nil, []*structures.DNSRecord{ns}), responseReferral},
+	}
+
+	for _, test := range tests {
+		if got := classifyResponse(test.response); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"DNSServer/lib/structures"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rootPrimingRetry is how long to wait before priming again when it has failed
+const rootPrimingRetry = time.Minute
+
+var errNoRootServers = errors.New("no root servers addresses found")
+
+var (
+	primedRootsMutex sync.RWMutex
+	primedRoots      []string
+)
+
+// rootServers returns addresses of root servers learned by priming,
+// or RootIPServers hints until priming has succeeded
+func rootServers() []string {
+	primedRootsMutex.RLock()
+	defer primedRootsMutex.RUnlock()
+
+	if primedRoots != nil {
+		return primedRoots
+	}
+	return RootIPServers
+}
+
+// LoadRootHints reads addresses of root servers from file in the format of
+// https://www.internic.net/domain/named.root, only addresses of names which
+// are listed as nameservers of the root are used
+func LoadRootHints(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	rootNameservers := make(map[string]bool)
+	addresses := make(map[string][]string)
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber += 1
+
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, ';'); comment != -1 {
+			line = line[:comment]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		owner, recordType, data, err := parseHintRecord(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+
+		switch recordType {
+		case "NS":
+			if owner == "" {
+				rootNameservers[data] = true
+			}
+		case "A", "AAAA":
+			addresses[owner] = append(addresses[owner], data)
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var hints []string
+	for nameserver := range rootNameservers {
+		hints = append(hints, addresses[nameserver]...)
+	}
+
+	if hints == nil {
+		return nil, fmt.Errorf("%s: %w", path, errNoRootServers)
+	}
+	return hints, nil
+}
+
+// parseHintRecord parses "<owner> [<TTL>] [<class>] <type> <RDATA>" line of the hints file,
+// names are returned in lower case without the trailing dot
+func parseHintRecord(fields []string) (owner, recordType, data string, err error) {
+	owner = normalizeHintName(fields[0])
+
+	rest := fields[1:]
+	for len(rest) > 0 {
+		if _, convErr := strconv.ParseUint(rest[0], 10, 32); convErr == nil || strings.EqualFold(rest[0], "IN") {
+			rest = rest[1:]
+			continue
+		}
+		break
+	}
+
+	if len(rest) != 2 {
+		return "", "", "", fmt.Errorf("expected owner, ttl, type and data, got %q", strings.Join(fields, " "))
+	}
+
+	recordType = strings.ToUpper(rest[0])
+	data = rest[1]
+	if recordType == "NS" {
+		data = normalizeHintName(data)
+	}
+	return
+}
+
+func normalizeHintName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// KeepRootsPrimed makes priming query to root servers hints and repeats it
+// when NS records of the root expire
+// https://datatracker.ietf.org/doc/html/rfc8109
+func KeepRootsPrimed() {
+	for {
+		ttl, err := primeRoots()
+		if err != nil {
+			log.Printf("root priming has failed, using hints: %s", err)
+			ttl = rootPrimingRetry
+		}
+		if ttl < rootPrimingRetry {
+			ttl = rootPrimingRetry
+		}
+
+		time.Sleep(ttl)
+	}
+}
+
+// primeRoots asks hints for NS records of the root and replaces root servers
+// with addresses from the answer. It returns the time the answer is valid for.
+func primeRoots() (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer cancel()
+
+	question := structures.NewDNSQuestion("", structures.QTypeNS, structures.QClassIN)
+	primingQuery := structures.NewQueryDNSMessage(question)
+
+	// https://datatracker.ietf.org/doc/html/rfc8109#section-3.1
+	// priming query is sent to servers from the hints, those not asked yet
+	// are picked in random order by ServersRTT
+	_, answer, err := askServers(ctx, primingQuery, RootIPServers...)
+	if err != nil {
+		return 0, err
+	}
+	sanitizeResponse(answer, "", question)
+
+	var ttl uint32
+	nameservers := make(map[string]bool)
+	for _, record := range answer.Answer {
+		if record.Type == structures.RecordTypeNS && record.Name == "" {
+			nameservers[strings.ToLower(record.RDataRepresentation)] = true
+			if ttl == 0 || record.TimeToLive < ttl {
+				ttl = record.TimeToLive
+			}
+		}
+	}
+
+	var addresses []string
+	for _, record := range answer.Additional {
+		if isAddressRecord(record) && nameservers[strings.ToLower(record.Name)] {
+			addresses = append(addresses, record.RDataRepresentation)
+		}
+	}
+
+	if addresses == nil {
+		return 0, fmt.Errorf("priming answer has %d nameservers: %w", len(nameservers), errNoRootServers)
+	}
+
+	primedRootsMutex.Lock()
+	primedRoots = addresses
+	primedRootsMutex.Unlock()
+
+	log.Printf("primed %d root servers addresses for %d seconds", len(addresses), ttl)
+	return time.Duration(ttl) * time.Second, nil
+}
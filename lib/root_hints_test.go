@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const namedRootSample = `;       This file holds the information on root name servers needed to
+;       initialize cache of Internet domain name servers
+;
+; FORMERLY NS.INTERNIC.NET
+;
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+;
+; FORMERLY NS1.ISI.EDU
+;
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2
+B.ROOT-SERVERS.NET.      3600000 IN   AAAA  2801:1b8:10::b
+;
+; not a root server, its address is not used
+ns.example.net.          3600000      A     192.0.2.53
+; End of file
+`
+
+func writeHints(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "named.root")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRootHints(t *testing.T) {
+	hints, err := LoadRootHints(writeHints(t, namedRootSample))
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+
+	sort.Strings(hints)
+	want := []string{"170.247.170.2", "198.41.0.4", "2001:503:ba3e::2:30", "2801:1b8:10::b"}
+	if strings.Join(hints, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", hints, want)
+	}
+}
+
+func TestLoadRootHintsRejectsMalformedLine(t *testing.T) {
+	content := strings.Replace(namedRootSample, "B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2",
+		"B.ROOT-SERVERS.NET.      3600000      A", 1)
+
+	_, err := LoadRootHints(writeHints(t, content))
+	if err == nil || !strings.Contains(err.Error(), ":13:") {
+		t.Errorf("got %v, want error about line 13", err)
+	}
+}
+
+func TestLoadRootHintsWithoutRootNameservers(t *testing.T) {
+	content := "A.ROOT-SERVERS.NET. 3600000 A 198.41.0.4\nexample.com. 3600 NS a.root-servers.net.\n"
+
+	_, err := LoadRootHints(writeHints(t, content))
+	if !errors.Is(err, errNoRootServers) {
+		t.Errorf("got %v, want %v", err, errNoRootServers)
+	}
+}
+
+func TestParseHintRecord(t *testing.T) {
+	tests := []struct {
+		line                    string
+		owner, recordType, data string
+		fails                   bool
+	}{
+		{line: ". 3600000 NS A.ROOT-SERVERS.NET.", owner: "", recordType: "NS", data: "a.root-servers.net"},
+		{line: "A.ROOT-SERVERS.NET. 3600000 IN A 198.41.0.4", owner: "a.root-servers.net", recordType: "A", data: "198.41.0.4"},
+		{line: "a.root-servers.net. aaaa 2001:503:ba3e::2:30", owner: "a.root-servers.net", recordType: "AAAA", data: "2001:503:ba3e::2:30"},
+		{line: "A.ROOT-SERVERS.NET. 3600000 A", fails: true},
+		{line: "A.ROOT-SERVERS.NET. 3600000 A 198.41.0.4 extra", fails: true},
+	}
+
+	for _, test := range tests {
+		owner, recordType, data, err := parseHintRecord(strings.Fields(test.line))
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q: no error", test.line)
+			}
+			continue
+		}
+		if err != nil || owner != test.owner || recordType != test.recordType || data != test.data {
+			t.Errorf("%q: got %q %q %q %v, want %q %q %q", test.line, owner, recordType, data, err,
+				test.owner, test.recordType, test.data)
+		}
+	}
+}
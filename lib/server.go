@@ -2,24 +2,79 @@ package lib
 
 import (
 	"DNSServer/lib/structures"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"sync"
+	"syscall"
+	"time"
 )
 
+const maxUDPMessageSize = 65535
+
 type IncomingRequest struct {
 	Address    net.Addr
 	DNSMessage *structures.DNSMessage
+
+	// Network the request came from, "udp" or "tcp"
+	Network string
+
+	// respond sends marshaled answer back to the client, it must be called
+	// exactly once per request, nil answer means the request is dropped
+	respond func(answer []byte)
 }
 
+var sendMutex sync.Mutex
+
+// RequestsReceiver starts udp and tcp listeners on every address of ListenAddresses.
+// Addresses the host does not have, like ::1 without ipv6, are skipped,
+// the server stops only if it is not able to listen on any address.
 func RequestsReceiver(exit chan bool) {
 	log.Println("starting server")
 
-	pc, err := net.ListenPacket("udp", "localhost:53")
-	if err != nil {
-		log.Fatalf("failed to start server because of %s", err)
+	// limit is shared by listeners of all addresses
+	connectionsSlots := make(chan struct{}, MaxTCPConnections)
+
+	listening := 0
+	for _, address := range ListenAddresses {
+		addressWithPort := net.JoinHostPort(address, "53")
+
+		pc, err := net.ListenPacket("udp", addressWithPort)
+		if isAddressNotAvailable(err) {
+			log.Printf("skipping %s because it is not available: %s", addressWithPort, err)
+			continue
+		}
+		if err != nil {
+			log.Fatalf("failed to start server on %s because of %s", addressWithPort, err)
+		}
+
+		listener, err := net.Listen("tcp", addressWithPort)
+		if err != nil {
+			log.Fatalf("failed to start tcp server on %s because of %s", addressWithPort, err)
+		}
+
+		log.Printf("listening on %s", addressWithPort)
+		go tcpRequestsReceiver(listener, connectionsSlots)
+		go udpRequestsReceiver(pc)
+		listening += 1
+	}
+
+	if listening == 0 {
+		log.Fatalf("none of listen addresses %v is available", ListenAddresses)
 	}
+}
 
-	buffer := make([]byte, 1024)
+// isAddressNotAvailable tells if listening has failed because the host has no
+// such address or does not support its ip version at all
+func isAddressNotAvailable(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EAFNOSUPPORT)
+}
+
+func udpRequestsReceiver(pc net.PacketConn) {
+	// udp message could be as big as client's EDNS payload size says
+	buffer := make([]byte, maxUDPMessageSize)
 	for {
 		n, addr, err := pc.ReadFrom(buffer)
 
@@ -29,12 +84,177 @@ func RequestsReceiver(exit chan bool) {
 
 		log.Printf("new request from %s bytes read %d", addr, n)
 
-		allMessage := buffer[:n]
-		parsedMessage, err := structures.UnmarshalMessage(allMessage)
 		incomingRequest := &IncomingRequest{
-			Address:    addr,
-			DNSMessage: parsedMessage,
+			Address: addr,
+			Network: "udp",
+			respond: func(answer []byte) {
+				if answer == nil {
+					return
+				}
+				sendMutex.Lock()
+				_, _ = pc.WriteTo(answer, addr)
+				sendMutex.Unlock()
+			},
+		}
+		handleRequest(incomingRequest, buffer[:n])
+	}
+}
+
+// tcpRequestsReceiver accepts tcp connections as specified in
+// https://datatracker.ietf.org/doc/html/rfc7766, connections over
+// MaxTCPConnections are closed right away.
+func tcpRequestsReceiver(listener net.Listener, connectionsSlots chan struct{}) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("error while accepting tcp connection: %s", err)
+			continue
+		}
+
+		select {
+		case connectionsSlots <- struct{}{}:
+		default:
+			log.Printf("too many tcp connections, closing connection from %s", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+
+		go func() {
+			serveTCPConnection(conn)
+			<-connectionsSlots
+		}()
+	}
+}
+
+// serveTCPConnection reads queries one after another from one connection,
+// they are resolved concurrently and answered in the order they are ready.
+// At most MaxTCPQueriesPerConnection queries are resolved at once, reading
+// waits for a free slot. Connection is closed after TCPIdleTimeout without
+// queries and answers in progress.
+func serveTCPConnection(conn net.Conn) {
+	var (
+		writeMutex sync.Mutex
+		inProgress sync.WaitGroup
+	)
+	queriesSlots := make(chan struct{}, MaxTCPQueriesPerConnection)
+
+	defer func() {
+		inProgress.Wait()
+		_ = conn.Close()
+	}()
+
+	addr := conn.RemoteAddr()
+	reader := &countingReader{reader: conn}
+	for {
+		queriesSlots <- struct{}{}
+		_ = conn.SetReadDeadline(time.Now().Add(TCPIdleTimeout))
+
+		reader.read = 0
+		data, err := readTCPMessage(reader)
+		if err != nil {
+			<-queriesSlots
+
+			// connection is not idle while answers are pending, but only untouched
+			// frame could be read again, the rest of a partly read one is misparsed
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && reader.read == 0 && len(queriesSlots) > 0 {
+				continue
+			}
+			if err != io.EOF {
+				log.Printf("closing tcp connection from %s: %s", addr, err)
+			}
+			return
+		}
+
+		log.Printf("new tcp request from %s bytes read %d", addr, len(data))
+
+		inProgress.Add(1)
+		incomingRequest := &IncomingRequest{
+			Address: addr,
+			Network: "tcp",
+			respond: func(answer []byte) {
+				defer inProgress.Done()
+				defer func() { <-queriesSlots }()
+
+				if answer == nil {
+					return
+				}
+
+				// client which does not read its answers must not block the writer forever
+				writeMutex.Lock()
+				_ = conn.SetWriteDeadline(time.Now().Add(TCPIdleTimeout))
+				err := writeTCPMessage(conn, answer)
+				writeMutex.Unlock()
+
+				if err != nil {
+					log.Printf("error while writing answer to %s, closing connection: %s", addr, err)
+					// reading is interrupted too, remaining queries fail on their writes quickly
+					_ = conn.Close()
+				}
+			},
 		}
-		go Resolve(incomingRequest, pc)
+		handleRequest(incomingRequest, data)
+	}
+}
+
+// countingReader remembers how many bytes were read since read was reset
+type countingReader struct {
+	reader io.Reader
+	read   int
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.reader.Read(p)
+	c.read += n
+	return
+}
+
+// handleRequest parses the query and starts resolving it, malformed queries are answered with FORMERR
+func handleRequest(incomingRequest *IncomingRequest, data []byte) {
+	parsedMessage, err := structures.UnmarshalMessage(data)
+	if err == nil {
+		err = validateQuery(parsedMessage)
 	}
+	incomingRequest.DNSMessage = parsedMessage
+
+	if err != nil {
+		log.Printf("malformed request from %s: %s", incomingRequest.Address, err)
+		answerError(incomingRequest, structures.RCodeFormatError)
+		return
+	}
+
+	if parsedMessage.Header.Opcode != structures.OpStandardQuery {
+		log.Printf("request from %s has not supported opcode %d", incomingRequest.Address, parsedMessage.Header.Opcode)
+		answerError(incomingRequest, structures.RCodeNotImplemented)
+		return
+	}
+
+	go Resolve(incomingRequest)
+}
+
+func validateQuery(message *structures.DNSMessage) error {
+	if message.Header.QR != structures.QRQuery {
+		return errors.New("message is not a query")
+	}
+
+	// https://stackoverflow.com/a/4083071
+	// "No one support multiply questions in DNS Message today"
+	if len(message.Questions) != 1 {
+		return fmt.Errorf("query has %d questions, expected exactly one", len(message.Questions))
+	}
+
+	return nil
+}
+
+// answerError replies rcode to the query which could not be handled.
+// Nothing is sent if even the header is broken, because there is no id to answer to.
+func answerError(incomingRequest *IncomingRequest, rcode byte) {
+	query := incomingRequest.DNSMessage
+	if query == nil || query.Header.QR != structures.QRQuery {
+		incomingRequest.respond(nil)
+		return
+	}
+
+	answer := structures.NewErrorAnswerDNSMessage(query.Questions, rcode)
+	writeAnswer(answer, incomingRequest, nil)
 }
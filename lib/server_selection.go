@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// smoothing of the measured rtt, the same weights as BIND uses
+	srttWeightOld = 0.7
+	srttWeightNew = 0.3
+
+	// servers which were not chosen become a bit faster on every selection,
+	// so the slower ones are tried again from time to time
+	srttDecay = 0.98
+
+	// rtt given to server which has failed, it is not used again until
+	// faster servers fail too
+	failedServerRTT = 10 * time.Second
+
+	// unknown servers get random small rtt, so every one of them is tried once
+	maxUnknownServerRTT = 32 * time.Millisecond
+
+	// servers not used for this long are forgotten
+	serverStatisticsLifetime = 30 * time.Minute
+
+	// 0x20 encoding is turned off for the server after so many exchanges in a
+	// row got only responses differing from the query in letter case
+	caseMismatchesToDisable = 3
+
+	// how long 0x20 encoding stays turned off, the server is tried with it again after that
+	caseRandomisationDisableTime = time.Hour
+)
+
+// ServerStatistics is what is known about one upstream server
+type ServerStatistics struct {
+	Address string
+
+	// SRTT is smoothed round trip time of exchanges with the server
+	SRTT time.Duration
+
+	// Failures is how many exchanges have failed in a row
+	Failures int
+
+	// BackoffUntil is the time before which the server is asked only if
+	// all other servers are backed off too
+	BackoffUntil time.Time
+
+	LastUsed time.Time
+
+	// SpoofedResponses is how many responses claiming to come from the server
+	// did not match the query
+	SpoofedResponses int
+
+	// CaseMismatches is how many exchanges in a row got only responses
+	// which differ from the query in letter case
+	CaseMismatches int
+
+	// CaseRandomisationDisabledUntil is set when the server does not seem to
+	// preserve case of names, 0x20 encoding is not used with it before that time
+	CaseRandomisationDisabledUntil time.Time
+}
+
+// RTTTable keeps statistics of upstream servers and orders servers to ask
+// by them, like BIND and Unbound do with SRTT.
+type RTTTable struct {
+	mutex   sync.Mutex
+	servers map[string]*ServerStatistics
+}
+
+func NewRTTTable() *RTTTable {
+	return &RTTTable{servers: make(map[string]*ServerStatistics)}
+}
+
+// ServersRTT is the table all upstream exchanges are recorded in
+var ServersRTT = NewRTTTable()
+
+// Order returns servers sorted from the one which should be asked first.
+// Backed off servers are put after all others, then servers of the preferred
+// ip version go before the others.
+func (t *RTTTable) Order(servers []string) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	ordered := make([]*ServerStatistics, 0, len(servers))
+	for _, server := range servers {
+		ordered = append(ordered, t.statistics(server, now))
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		iBackedOff := ordered[i].BackoffUntil.After(now)
+		jBackedOff := ordered[j].BackoffUntil.After(now)
+		if iBackedOff != jBackedOff {
+			return jBackedOff
+		}
+		iPreferred := isPreferredAddress(ordered[i].Address)
+		jPreferred := isPreferredAddress(ordered[j].Address)
+		if iPreferred != jPreferred {
+			return iPreferred
+		}
+		return ordered[i].SRTT < ordered[j].SRTT
+	})
+
+	result := make([]string, len(ordered))
+	for i, statistics := range ordered {
+		result[i] = statistics.Address
+		if i != 0 {
+			statistics.SRTT = time.Duration(float64(statistics.SRTT) * srttDecay)
+		}
+	}
+
+	return result
+}
+
+// RecordSuccess updates SRTT of the server with rtt of a successful exchange
+func (t *RTTTable) RecordSuccess(server string, rtt time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	statistics := t.statistics(server, now)
+	statistics.SRTT = time.Duration(srttWeightOld*float64(statistics.SRTT) + srttWeightNew*float64(rtt))
+	statistics.Failures = 0
+	statistics.BackoffUntil = time.Time{}
+	statistics.LastUsed = now
+}
+
+// RecordFailure penalizes the server which has timed out or answered with
+// an error, every failure in a row doubles the backoff up to MaxServerBackoff
+func (t *RTTTable) RecordFailure(server string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	statistics := t.statistics(server, now)
+	statistics.SRTT = failedServerRTT
+	statistics.Failures += 1
+	statistics.LastUsed = now
+
+	backoff := ServerBackoff
+	for i := 1; i < statistics.Failures && backoff < MaxServerBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxServerBackoff {
+		backoff = MaxServerBackoff
+	}
+	statistics.BackoffUntil = now.Add(backoff)
+}
+
+// RecordSpoofedResponse counts response which did not match the query sent to the server
+func (t *RTTTable) RecordSpoofedResponse(server string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.statistics(server, time.Now()).SpoofedResponses += 1
+}
+
+// RecordCaseMismatch counts exchange which got only responses differing from
+// the query in letter case. One such response could be forged by somebody who
+// has guessed the id, so 0x20 encoding is turned off only after several of
+// them in a row and only for caseRandomisationDisableTime.
+func (t *RTTTable) RecordCaseMismatch(server string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	statistics := t.statistics(server, now)
+	statistics.CaseMismatches += 1
+	if statistics.CaseMismatches >= caseMismatchesToDisable {
+		statistics.CaseMismatches = 0
+		statistics.CaseRandomisationDisabledUntil = now.Add(caseRandomisationDisableTime)
+	}
+}
+
+// RecordCasePreserved resets mismatches of the server after it has echoed randomised case
+func (t *RTTTable) RecordCasePreserved(server string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.statistics(server, time.Now()).CaseMismatches = 0
+}
+
+// CaseRandomisationAllowed tells if names in queries to the server could be 0x20 encoded
+func (t *RTTTable) CaseRandomisationAllowed(server string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	return !t.statistics(server, now).CaseRandomisationDisabledUntil.After(now)
+}
+
+// Snapshot returns copy of the table sorted by SRTT, it is meant for inspection only
+func (t *RTTTable) Snapshot() []ServerStatistics {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	snapshot := make([]ServerStatistics, 0, len(t.servers))
+	for _, statistics := range t.servers {
+		snapshot = append(snapshot, *statistics)
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].SRTT < snapshot[j].SRTT
+	})
+	return snapshot
+}
+
+// statistics returns entry of the server, creating it when the server is unknown.
+// t.mutex has to be held.
+func (t *RTTTable) statistics(server string, now time.Time) *ServerStatistics {
+	statistics, ok := t.servers[server]
+	if ok {
+		return statistics
+	}
+
+	t.forgetUnused(now)
+
+	statistics = &ServerStatistics{
+		Address:  server,
+		SRTT:     time.Duration(rand.Int63n(int64(maxUnknownServerRTT))),
+		LastUsed: now,
+	}
+	t.servers[server] = statistics
+	return statistics
+}
+
+func (t *RTTTable) forgetUnused(now time.Time) {
+	for server, statistics := range t.servers {
+		if now.Sub(statistics.LastUsed) > serverStatisticsLifetime {
+			delete(t.servers, server)
+		}
+	}
+}
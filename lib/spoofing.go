@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"DNSServer/lib/structures"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+var errResponseMismatch = errors.New("response does not match the query")
+
+// spoofedResponses counts responses which did not match the query they came for
+var spoofedResponses uint64
+
+// SpoofedResponses returns how many upstream responses were dropped because
+// they did not match the query, they are either spoofing attempts or late
+// answers to earlier queries
+func SpoofedResponses() uint64 {
+	return atomic.LoadUint64(&spoofedResponses)
+}
+
+// checkResponse tells if data is the response to query: it has to have the same id,
+// QR bit set and the same question, names have to match exactly when exactCase is set
+// https://datatracker.ietf.org/doc/html/rfc5452#section-3
+func checkResponse(query *structures.DNSMessage, data []byte, exactCase bool) error {
+	header, unreadData, err := structures.UnmarshalHeader(data)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errResponseMismatch, err)
+	}
+
+	if header.Id != query.Header.Id {
+		return fmt.Errorf("%w: id %d instead of %d", errResponseMismatch, header.Id, query.Header.Id)
+	}
+
+	if header.QR != structures.QRResponse {
+		return fmt.Errorf("%w: message is not a response", errResponseMismatch)
+	}
+
+	// some servers do not copy the question into error responses
+	if header.QDCOUNT == 0 && header.RCODE != structures.RCodeNoError {
+		return nil
+	}
+
+	questions, _, err := structures.UnmarshalQuestions(unreadData, data, int(header.QDCOUNT))
+	if err != nil {
+		return fmt.Errorf("%w: %s", errResponseMismatch, err)
+	}
+
+	if len(questions) != len(query.Questions) {
+		return fmt.Errorf("%w: %d questions instead of %d", errResponseMismatch, len(questions), len(query.Questions))
+	}
+
+	for i, question := range questions {
+		asked := query.Questions[i]
+		if !strings.EqualFold(question.QName, asked.QName) || question.QType != asked.QType ||
+			question.QClass != asked.QClass {
+			return fmt.Errorf("%w: question %s %d %d instead of %s %d %d", errResponseMismatch,
+				question.QName, question.QType, question.QClass, asked.QName, asked.QType, asked.QClass)
+		}
+
+		if exactCase && question.QName != asked.QName {
+			return fmt.Errorf("%w: %s instead of %s", errCaseMismatch, question.QName, asked.QName)
+		}
+	}
+
+	return nil
+}
+
+func countSpoofedResponse(server string, err error) {
+	log.Printf("dropping response from %s: %s", server, err)
+	atomic.AddUint64(&spoofedResponses, 1)
+	ServersRTT.RecordSpoofedResponse(server)
+}
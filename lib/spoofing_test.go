@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"DNSServer/lib/structures"
+	"errors"
+	"testing"
+)
+
+func TestCheckResponse(t *testing.T) {
+	query := structures.NewQueryDNSMessage(structures.NewDNSQuestion("wWw.ExAmPlE.cOm", structures.QTypeA, structures.QClassIN))
+	query.Header.Id = 0x1234
+
+	response := func(change func(response *structures.DNSMessage)) []byte {
+		message := structures.NewAnswerDNSMessage(
+			[]*structures.DNSQuestion{structures.NewDNSQuestion("wWw.ExAmPlE.cOm", structures.QTypeA, structures.QClassIN)}, nil)
+		message.Header.Id = query.Header.Id
+		if change != nil {
+			change(message)
+		}
+		return message.Marshal()
+	}
+	question := func(qname string, qtype structures.QType) func(*structures.DNSMessage) {
+		return func(response *structures.DNSMessage) {
+			response.Questions = []*structures.DNSQuestion{structures.NewDNSQuestion(qname, qtype, structures.QClassIN)}
+		}
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		exactCase bool
+		want      error
+	}{
+		{"matching response", response(nil), true, nil},
+		{"wrong id", response(func(response *structures.DNSMessage) { response.Header.Id = 0x4321 }), false, errResponseMismatch},
+		{"not a response", response(func(response *structures.DNSMessage) { response.Header.QR = structures.QRQuery }), false, errResponseMismatch},
+		{"different name", response(question("www.example.net", structures.QTypeA)), false, errResponseMismatch},
+		{"different type", response(question("wWw.ExAmPlE.cOm", structures.QTypeAAAA)), false, errResponseMismatch},
+		{"no question", response(question("", structures.QTypeA)), false, errResponseMismatch},
+		{"case mismatch", response(question("www.example.com", structures.QTypeA)), true, errCaseMismatch},
+		{"case mismatch without 0x20", response(question("www.example.com", structures.QTypeA)), false, nil},
+		{"error without question", response(func(response *structures.DNSMessage) {
+			response.Questions = nil
+			response.Header.RCODE = structures.RCodeServerFailure
+		}), false, nil},
+		{"truncated header", []byte{0x12, 0x34, 0x80}, false, errResponseMismatch},
+	}
+
+	for _, test := range tests {
+		err := checkResponse(query, test.data, test.exactCase)
+		if test.want == nil && err != nil || !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package structures
+
+// Credibility ranks data by where it was received from, cached data is not
+// replaced by less credible data while it is within TTL
+// https://datatracker.ietf.org/doc/html/rfc2181#section-5.4.1
+type Credibility int
+
+const (
+	// Additional section of any answer, glue and authority section of non-authoritative answer
+	CredibilityAdditional Credibility = iota
+
+	// Answer section of non-authoritative answer
+	CredibilityNonAuthAnswer
+
+	// Authority section of authoritative answer
+	CredibilityAuthAuthority
+
+	// Answer section of authoritative answer
+	CredibilityAuthAnswer
+)
+
+// AnswerCredibility is credibility of the answer section of message
+func AnswerCredibility(message *DNSMessage) Credibility {
+	if message.Header.AA == 1 {
+		return CredibilityAuthAnswer
+	}
+	return CredibilityNonAuthAnswer
+}
@@ -0,0 +1,242 @@
+package structures
+
+import (
+	"DNSServer/lib/helpers"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DelegationCache keeps zone cuts learned from referrals, NS records of the
+// zones and addresses of their nameservers, so resolution could start from
+// the closest known zone instead of the root.
+// https://datatracker.ietf.org/doc/html/rfc1034#section-5.3.3
+//
+// Zones and nameserver names are limited to maxEntries each, when a new one
+// does not fit expired entries are removed and if that is not enough, random
+// ones are. Zero maxEntries means no limit.
+type DelegationCache struct {
+	mutex      sync.Mutex
+	maxEntries int
+
+	// NS records by zone name
+	zones map[string][]cachedRecord
+
+	// A and AAAA records by nameserver name, both from glue and from resolution
+	addresses map[string][]cachedRecord
+}
+
+type cachedRecord struct {
+	record      *DNSRecord
+	expiresAt   time.Time
+	credibility Credibility
+}
+
+func NewDelegationCache(maxEntries int) *DelegationCache {
+	return &DelegationCache{
+		maxEntries: maxEntries,
+		zones:      make(map[string][]cachedRecord),
+		addresses:  make(map[string][]cachedRecord),
+	}
+}
+
+// SetDelegation replaces NS records of zone with ones from the referral, addresses
+// of nameservers are taken from glue, records of other names and types are ignored.
+// Referral data has the lowest credibility, addresses learned from answers are kept.
+func (c *DelegationCache) SetDelegation(zone string, nameservers []*DNSRecord, glue []*DNSRecord) {
+	now := time.Now()
+
+	var zoneRecords []cachedRecord
+	nameserverNames := make(map[string]bool)
+	for _, record := range nameservers {
+		if record.Type != RecordTypeNS || !strings.EqualFold(record.Name, zone) {
+			continue
+		}
+		zoneRecords = append(zoneRecords, newCachedRecord(record, now, CredibilityAdditional))
+		nameserverNames[strings.ToLower(record.RDataRepresentation)] = true
+	}
+
+	if zoneRecords == nil {
+		return
+	}
+
+	addresses := make(map[string][]cachedRecord)
+	for _, record := range glue {
+		name := strings.ToLower(record.Name)
+		if !isAddress(record) || !nameserverNames[name] {
+			continue
+		}
+		addresses[name] = append(addresses[name], newCachedRecord(record, now, CredibilityAdditional))
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	zone = strings.ToLower(zone)
+	if replaceable(c.zones[zone], CredibilityAdditional, now) {
+		c.store(c.zones, zone, zoneRecords, now)
+	}
+	for name, records := range addresses {
+		if replaceable(c.addresses[name], CredibilityAdditional, now) {
+			c.store(c.addresses, name, records, now)
+		}
+	}
+}
+
+// SetAddresses replaces cached addresses of nameserver name, unless
+// addresses with higher credibility are cached already
+func (c *DelegationCache) SetAddresses(name string, addresses []*DNSRecord, credibility Credibility) {
+	now := time.Now()
+
+	var records []cachedRecord
+	for _, record := range addresses {
+		if isAddress(record) {
+			records = append(records, newCachedRecord(record, now, credibility))
+		}
+	}
+
+	if records == nil {
+		return
+	}
+
+	name = strings.ToLower(name)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if replaceable(c.addresses[name], credibility, now) {
+		c.store(c.addresses, name, records, now)
+	}
+}
+
+// Addresses returns not expired addresses of nameserver name
+func (c *DelegationCache) Addresses(name string) []*DNSRecord {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.unexpiredAddresses(name, time.Now())
+}
+
+// ClosestDelegation finds the closest zone enclosing name which still has
+// NS records and addresses of at least one of its nameservers. Returned
+// records are copies with TTL decreased by the time spent in cache.
+// Root zone is never cached, ok is false when resolution has to start from it.
+func (c *DelegationCache) ClosestDelegation(name string) (zone string, nameservers []*DNSRecord, addresses []*DNSRecord, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for zone = strings.ToLower(strings.TrimSuffix(name, ".")); zone != ""; zone = helpers.ParentName(zone) {
+		nameservers = unexpired(c.zones[zone], now)
+		if nameservers == nil {
+			delete(c.zones, zone)
+			continue
+		}
+
+		addresses = nil
+		for _, nameserver := range nameservers {
+			addresses = append(addresses, c.unexpiredAddresses(nameserver.RDataRepresentation, now)...)
+		}
+
+		if addresses != nil {
+			return zone, nameservers, addresses, true
+		}
+	}
+
+	return "", nil, nil, false
+}
+
+// RemoveExpired deletes zones and nameserver names none of whose records could
+// be used anymore, it returns how many were deleted
+func (c *DelegationCache) RemoveExpired() int {
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return removeExpired(c.zones, now) + removeExpired(c.addresses, now)
+}
+
+// Len returns how many zones and how many nameserver names are cached
+func (c *DelegationCache) Len() (zones, nameservers int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.zones), len(c.addresses)
+}
+
+// store puts records of the new key into entries only if they fit into
+// maxEntries, making room when needed. c.mutex has to be held.
+func (c *DelegationCache) store(entries map[string][]cachedRecord, key string, records []cachedRecord, now time.Time) {
+	if _, ok := entries[key]; !ok && c.maxEntries > 0 && len(entries) >= c.maxEntries {
+		removeExpired(entries, now)
+
+		// iteration order of a map is random, so random entries are evicted
+		for evicted := range entries {
+			if len(entries) < c.maxEntries {
+				break
+			}
+			delete(entries, evicted)
+		}
+	}
+
+	entries[key] = records
+}
+
+func removeExpired(entries map[string][]cachedRecord, now time.Time) (removed int) {
+	for key, records := range entries {
+		if unexpired(records, now) == nil {
+			delete(entries, key)
+			removed += 1
+		}
+	}
+	return
+}
+
+// unexpiredAddresses has to be called with c.mutex held
+func (c *DelegationCache) unexpiredAddresses(name string, now time.Time) []*DNSRecord {
+	name = strings.ToLower(name)
+
+	addresses := unexpired(c.addresses[name], now)
+	if addresses == nil {
+		delete(c.addresses, name)
+	}
+	return addresses
+}
+
+func newCachedRecord(record *DNSRecord, now time.Time, credibility Credibility) cachedRecord {
+	return cachedRecord{
+		record:      record,
+		expiresAt:   now.Add(time.Duration(record.TimeToLive) * time.Second),
+		credibility: credibility,
+	}
+}
+
+// replaceable tells if cached records could be replaced by records with credibility,
+// only expired records could be replaced by less credible ones
+func replaceable(cached []cachedRecord, credibility Credibility, now time.Time) bool {
+	for _, record := range cached {
+		if record.credibility > credibility && record.expiresAt.After(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// unexpired returns copies of records which are still within TTL
+func unexpired(records []cachedRecord, now time.Time) (result []*DNSRecord) {
+	for _, cached := range records {
+		if !cached.expiresAt.After(now) {
+			continue
+		}
+
+		recordCopy := *cached.record
+		recordCopy.TimeToLive = uint32(cached.expiresAt.Sub(now) / time.Second)
+		result = append(result, &recordCopy)
+	}
+	return
+}
+
+func isAddress(record *DNSRecord) bool {
+	return record.Type == RecordTypeA || record.Type == RecordTypeAAAA
+}
@@ -0,0 +1,44 @@
+package structures
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestDelegationCacheIsBounded(t *testing.T) {
+	cache := NewDelegationCache(3)
+	for i := 0; i < 10; i++ {
+		zone := fmt.Sprintf("zone%d.example", i)
+		nameserver := "ns." + zone
+		cache.SetDelegation(zone,
+			[]*DNSRecord{NewDNSRecord(zone, RecordClassIN, 3600, &NS{Host: nameserver})},
+			[]*DNSRecord{NewDNSRecord(nameserver, RecordClassIN, 3600, &A{Address: net.ParseIP("192.0.2.1").To4()})})
+	}
+
+	if zones, nameservers := cache.Len(); zones != 3 || nameservers != 3 {
+		t.Errorf("got %d zones and %d nameservers, want 3 and 3", zones, nameservers)
+	}
+
+	// the last delegation is always kept
+	if zone, _, _, ok := cache.ClosestDelegation("www.zone9.example"); !ok || zone != "zone9.example" {
+		t.Errorf("got %q %v, want zone9.example", zone, ok)
+	}
+}
+
+func TestDelegationCacheRemoveExpired(t *testing.T) {
+	cache := NewDelegationCache(0)
+	cache.SetAddresses("ns.expired.example", []*DNSRecord{
+		NewDNSRecord("ns.expired.example", RecordClassIN, 0, &A{Address: net.ParseIP("192.0.2.1").To4()}),
+	}, CredibilityAuthAnswer)
+	cache.SetAddresses("ns.alive.example", []*DNSRecord{
+		NewDNSRecord("ns.alive.example", RecordClassIN, 3600, &A{Address: net.ParseIP("192.0.2.2").To4()}),
+	}, CredibilityAuthAnswer)
+
+	if removed := cache.RemoveExpired(); removed != 1 {
+		t.Errorf("removed %d, want 1", removed)
+	}
+	if _, nameservers := cache.Len(); nameservers != 1 {
+		t.Errorf("got %d nameservers, want 1", nameservers)
+	}
+}
@@ -3,10 +3,10 @@ package structures
 import (
 	"DNSServer/lib/helpers"
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"math/bits"
-	"math/rand"
 )
 
 const HeaderLength = 12
@@ -30,6 +30,17 @@ const (
 	OpServerStatusRequest
 )
 
+// Response codes as specified in
+// https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.1
+const (
+	RCodeNoError        byte = iota // No error condition
+	RCodeFormatError                // The name server was unable to interpret the query.
+	RCodeServerFailure              // The name server was unable to process this query due to a problem with the name server.
+	RCodeNameError                  // The domain name referenced in the query does not exist.
+	RCodeNotImplemented             // The name server does not support the requested kind of query.
+	RCodeRefused                    // The name server refuses to perform the specified operation for policy reasons.
+)
+
 type DNSHeader struct {
 	/*
 		DNSHeader as specified in
@@ -93,8 +104,19 @@ type DNSHeader struct {
 	ARCOUNT uint16
 }
 
+// NewMessageID returns cryptographically random message id, so answers
+// could not be forged by guessing it
+// https://datatracker.ietf.org/doc/html/rfc5452#section-9.2
+func NewMessageID() uint16 {
+	id := make([]byte, 2)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("failed to read random message id: %s", err))
+	}
+	return binary.BigEndian.Uint16(id)
+}
+
 func NewDNSHeader(QR RequestType, opcode OpcodeType, AA byte, TC byte, RD byte, RA byte, z byte, RCODE byte, QDCOUNT uint16, ANCOUNT uint16, NSCOUNT uint16, ARCOUNT uint16) *DNSHeader {
-	id := uint16(rand.Uint32())
+	id := NewMessageID()
 	return &DNSHeader{
 		Id:      id,
 		QR:      QR,
@@ -201,14 +223,18 @@ func (d *DNSHeader) Marshal() (res []byte) {
 	return
 }
 
+// ErrTruncatedHeader is returned when message is shorter than HeaderLength
+var ErrTruncatedHeader = errors.New("message is shorter than dns header")
+
 func UnmarshalHeader(data []byte) (header *DNSHeader, unreadData []byte, err error) {
+	if len(data) < HeaderLength {
+		return nil, nil, ErrTruncatedHeader
+	}
+
 	headerReader := bytes.NewReader(data[:HeaderLength])
 
 	var packet marshaledHeaderPacket
-	err = binary.Read(headerReader, binary.BigEndian, &packet)
-	if err != nil {
-		fmt.Println(err)
-	}
+	_ = binary.Read(headerReader, binary.BigEndian, &packet)
 
 	qr, opcode, aa, tc, rd := parseFirstPartOfFlags(packet.FirstPartOfFlags)
 	ra, z, rcode := parseSecondPartOfFlags(packet.SecondPartOfFlags)
@@ -233,24 +259,27 @@ func UnmarshalHeader(data []byte) (header *DNSHeader, unreadData []byte, err err
 	return
 }
 
+// flags are read starting from the least significant bit, so multi-bit
+// fields (Opcode, RCODE) keep their bit order
+
 func parseFirstPartOfFlags(firstPartOfFlags byte) (qr, opcode, aa, tc, rd byte) {
-	reversed := bits.Reverse8(firstPartOfFlags)
+	rest := firstPartOfFlags
 
-	qr, reversed = helpers.ReadLastNBitsAndShift(reversed, 1)
-	opcode, reversed = helpers.ReadLastNBitsAndShift(reversed, 4)
-	aa, reversed = helpers.ReadLastNBitsAndShift(reversed, 1)
-	tc, reversed = helpers.ReadLastNBitsAndShift(reversed, 1)
-	rd, reversed = helpers.ReadLastNBitsAndShift(reversed, 1)
+	rd, rest = helpers.ReadLastNBitsAndShift(rest, 1)
+	tc, rest = helpers.ReadLastNBitsAndShift(rest, 1)
+	aa, rest = helpers.ReadLastNBitsAndShift(rest, 1)
+	opcode, rest = helpers.ReadLastNBitsAndShift(rest, 4)
+	qr, _ = helpers.ReadLastNBitsAndShift(rest, 1)
 
 	return
 }
 
 func parseSecondPartOfFlags(secondPartOfFlags byte) (ra, z, rcode byte) {
-	reversed := bits.Reverse8(secondPartOfFlags)
+	rest := secondPartOfFlags
 
-	ra, reversed = helpers.ReadLastNBitsAndShift(reversed, 1)
-	z, reversed = helpers.ReadLastNBitsAndShift(reversed, 3)
-	rcode, _ = helpers.ReadLastNBitsAndShift(reversed, 4)
+	rcode, rest = helpers.ReadLastNBitsAndShift(rest, 4)
+	z, rest = helpers.ReadLastNBitsAndShift(rest, 3)
+	ra, _ = helpers.ReadLastNBitsAndShift(rest, 1)
 
 	return
 }
@@ -2,6 +2,8 @@ package structures
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 )
 
 type DNSMessage struct {
@@ -30,53 +32,118 @@ func NewAnswerDNSMessage(questions []*DNSQuestion, answers []*DNSRecord) *DNSMes
 	return NewDNSMessage(header, questions, answers, nil, nil)
 }
 
+// NewErrorAnswerDNSMessage makes an answer without records which reports rcode for the questions
+func NewErrorAnswerDNSMessage(questions []*DNSQuestion, rcode byte) *DNSMessage {
+	message := NewAnswerDNSMessage(questions, nil)
+	message.Header.RCODE = rcode
+	return message
+}
+
+// Copy returns message with its own header and sections, records themselves are shared
+func (m *DNSMessage) Copy() *DNSMessage {
+	header := *m.Header
+	return &DNSMessage{
+		Header:     &header,
+		Questions:  append([]*DNSQuestion(nil), m.Questions...),
+		Answer:     append([]*DNSRecord(nil), m.Answer...),
+		Authority:  append([]*DNSRecord(nil), m.Authority...),
+		Additional: append([]*DNSRecord(nil), m.Additional...),
+	}
+}
+
+// Marshal writes all four sections of the message. Section counts in the
+// written header are taken from the slices, counts stored in m.Header are ignored.
 func (m *DNSMessage) Marshal() (res []byte) {
 	buffer := new(bytes.Buffer)
 	namePositions := make(map[string]int)
 
-	buffer.Write(m.Header.Marshal())
+	header := *m.Header
+	header.QDCOUNT = uint16(len(m.Questions))
+	header.ANCOUNT = uint16(len(m.Answer))
+	header.NSCOUNT = uint16(len(m.Authority))
+	header.ARCOUNT = uint16(len(m.Additional))
+	buffer.Write(header.Marshal())
 
 	for _, question := range m.Questions {
-		namePositions[question.QName] = buffer.Len() - 1
-		buffer.Write(question.Marshal())
+		question.marshalTo(buffer, namePositions)
 	}
 
 	for _, answer := range m.Answer {
-		buffer.Write(answer.Marshal(namePositions))
+		answer.marshalTo(buffer, namePositions)
+	}
+
+	for _, authority := range m.Authority {
+		authority.marshalTo(buffer, namePositions)
 	}
 
 	for _, additional := range m.Additional {
-		buffer.Write(additional.Marshal(namePositions))
+		additional.marshalTo(buffer, namePositions)
 	}
 
 	res = buffer.Bytes()
 	return
 }
 
+// ErrTrailingData is returned when octets are left after all sections declared in the header
+var ErrTrailingData = errors.New("trailing data after the last section")
+
+// DecodeError tells in which section of the message decoding has failed
+type DecodeError struct {
+	Section string
+
+	// offset of the section start in the message
+	Offset int
+
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("malformed %s section at offset %d: %s", e.Section, e.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// UnmarshalMessage parses message from the wire format. On error message
+// contains everything that was parsed before the failure (or is nil if even
+// the header is broken), so the caller is able to answer with FORMERR.
 func UnmarshalMessage(data []byte) (message *DNSMessage, err error) {
-	header, unreadData, _ := UnmarshalHeader(data)
+	header, unreadData, err := UnmarshalHeader(data)
+	if err != nil {
+		return nil, &DecodeError{Section: "header", Offset: 0, Err: err}
+	}
+
 	message = &DNSMessage{
 		Header: header,
 	}
 
-	questionsCount := int(header.QDCOUNT)
-	if questionsCount >= 1 {
-		message.Questions, unreadData = UnmarshalQuestions(unreadData, questionsCount)
+	offset := len(data) - len(unreadData)
+	message.Questions, unreadData, err = UnmarshalQuestions(unreadData, data, int(header.QDCOUNT))
+	if err != nil {
+		return message, &DecodeError{Section: "question", Offset: offset, Err: err}
+	}
+
+	offset = len(data) - len(unreadData)
+	message.Answer, unreadData, err = UnmarshalRecords(unreadData, data, int(header.ANCOUNT))
+	if err != nil {
+		return message, &DecodeError{Section: "answer", Offset: offset, Err: err}
 	}
 
-	answersCount := int(header.ANCOUNT)
-	if answersCount >= 1 {
-		message.Answer, unreadData = UnmarshalRecords(unreadData, data, answersCount)
+	offset = len(data) - len(unreadData)
+	message.Authority, unreadData, err = UnmarshalRecords(unreadData, data, int(header.NSCOUNT))
+	if err != nil {
+		return message, &DecodeError{Section: "authority", Offset: offset, Err: err}
 	}
 
-	authorityCount := int(header.NSCOUNT)
-	if authorityCount >= 1 {
-		message.Authority, unreadData = UnmarshalRecords(unreadData, data, authorityCount)
+	offset = len(data) - len(unreadData)
+	message.Additional, unreadData, err = UnmarshalRecords(unreadData, data, int(header.ARCOUNT))
+	if err != nil {
+		return message, &DecodeError{Section: "additional", Offset: offset, Err: err}
 	}
 
-	additionalCount := int(header.ARCOUNT)
-	if additionalCount >= 1 {
-		message.Additional, unreadData = UnmarshalRecords(unreadData, data, additionalCount)
+	if len(unreadData) != 0 {
+		return message, &DecodeError{Section: "message", Offset: len(data) - len(unreadData), Err: ErrTrailingData}
 	}
 
 	return
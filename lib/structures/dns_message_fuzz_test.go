@@ -0,0 +1,31 @@
+//go:build go1.18
+
+package structures
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzUnmarshalMessage(f *testing.F) {
+	f.Add(roundTripMessage().Marshal())
+	f.Add(NewQueryDNSMessage(NewDNSQuestion("example.com", 1, 1)).Marshal())
+	f.Add([]byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 0x0C, 0, 1, 0, 1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, err := UnmarshalMessage(data)
+		if err != nil {
+			return
+		}
+
+		// whatever was parsed has to be written back to a message which parses the same
+		marshaled := message.Marshal()
+		again, err := UnmarshalMessage(marshaled)
+		if err != nil {
+			t.Fatalf("parsed message does not parse after marshal: %s", err)
+		}
+		if !bytes.Equal(again.Marshal(), marshaled) {
+			t.Fatalf("message changes after second round trip")
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package structures
+
+import (
+	"DNSServer/lib/helpers"
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func roundTripMessage() *DNSMessage {
+	owner := "www.example.com"
+	answer := []*DNSRecord{
+		NewDNSRecord(owner, RecordClassIN, 300, &A{Address: net.ParseIP("192.0.2.1").To4()}),
+		NewDNSRecord(owner, RecordClassIN, 300, &AAAA{Address: net.ParseIP("2001:db8::1")}),
+		NewDNSRecord(owner, RecordClassIN, 300, &CNAME{Target: "alias.example.com"}),
+		NewDNSRecord(owner, RecordClassIN, 300, &PTR{Target: "ptr.example.com"}),
+		NewDNSRecord(owner, RecordClassIN, 300, &MX{Preference: 10, Exchange: "mail.example.com"}),
+		NewDNSRecord(owner, RecordClassIN, 300, &TXT{Strings: []string{"first", "second string"}}),
+		NewDNSRecord(owner, RecordClassIN, 300, &SRV{Priority: 1, Weight: 2, Port: 5060, Target: "sip.example.org"}),
+		NewDNSRecord(owner, RecordClassIN, 300, &CAA{Flags: 0, Tag: "issue", Value: "ca.example.net"}),
+		{Name: owner, Type: 99, Class: RecordClassIN, TimeToLive: 300, RDATA: []byte{1, 2, 3}},
+	}
+	authority := []*DNSRecord{
+		NewDNSRecord("example.com", RecordClassIN, 3600, &NS{Host: "ns1.example.com"}),
+		NewDNSRecord("example.com", RecordClassIN, 3600, &SOA{
+			MName: "ns1.example.com", RName: "hostmaster.example.com",
+			Serial: 2024010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300,
+		}),
+	}
+	additional := []*DNSRecord{
+		// owner is compressed against the NS target written in the authority section
+		NewDNSRecord("ns1.example.com", RecordClassIN, 3600, &A{Address: net.ParseIP("192.0.2.53").To4()}),
+		{Name: "", Type: RecordTypeOPT, Class: 1232, Data: &OPT{Options: []EDNSOption{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}}}},
+	}
+
+	message := NewAnswerDNSMessage([]*DNSQuestion{NewDNSQuestion(owner, 1, 1)}, answer)
+	message.Authority = authority
+	message.Additional = additional
+	return message
+}
+
+func compareRecords(t *testing.T, section string, got, want []*DNSRecord) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d records, want %d", section, len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Name != want[i].Name || got[i].Type != want[i].Type ||
+			got[i].Class != want[i].Class || got[i].TimeToLive != want[i].TimeToLive {
+			t.Errorf("%s[%d]: got %s %d %d %d, want %s %d %d %d", section, i,
+				got[i].Name, got[i].Type, got[i].Class, got[i].TimeToLive,
+				want[i].Name, want[i].Type, want[i].Class, want[i].TimeToLive)
+		}
+		if want[i].Data == nil {
+			if got[i].Data != nil || !bytes.Equal(got[i].RDATA, want[i].RDATA) {
+				t.Errorf("%s[%d]: got rdata %v %x, want %x", section, i, got[i].Data, got[i].RDATA, want[i].RDATA)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got[i].Data, want[i].Data) {
+			t.Errorf("%s[%d]: got %s, want %s", section, i, got[i].Data, want[i].Data)
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	message := roundTripMessage()
+	message.Header.Id = 0xBEEF
+
+	parsed, err := UnmarshalMessage(message.Marshal())
+	if err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+
+	if parsed.Header.Id != 0xBEEF || parsed.Header.QR != message.Header.QR {
+		t.Errorf("header: got %+v, want %+v", parsed.Header, message.Header)
+	}
+	if len(parsed.Questions) != 1 || *parsed.Questions[0] != *message.Questions[0] {
+		t.Errorf("question: got %+v, want %+v", parsed.Questions, message.Questions)
+	}
+	compareRecords(t, "answer", parsed.Answer, message.Answer)
+	compareRecords(t, "authority", parsed.Authority, message.Authority)
+	compareRecords(t, "additional", parsed.Additional, message.Additional)
+}
+
+func TestMessageCompressesNamesAcrossSections(t *testing.T) {
+	data := roundTripMessage().Marshal()
+
+	// every owner and RDATA name except the SRV target ends in example.com,
+	// so with pointers reused across sections its labels are written only once
+	for _, labels := range []string{"\x07example\x03com\x00", "\x03www\x07example", "\x03ns1"} {
+		if count := bytes.Count(data, []byte(labels)); count != 1 {
+			t.Errorf("%q is written %d times, want 1", labels, count)
+		}
+	}
+}
+
+func TestSRVTargetIsNotCompressed(t *testing.T) {
+	target := "sip.example.com"
+	message := NewAnswerDNSMessage(
+		[]*DNSQuestion{NewDNSQuestion("_sip._udp."+target, 33, 1)},
+		[]*DNSRecord{NewDNSRecord("_sip._udp."+target, RecordClassIN, 300,
+			&SRV{Priority: 1, Weight: 2, Port: 5060, Target: target})},
+	)
+	data := message.Marshal()
+
+	// https://datatracker.ietf.org/doc/html/rfc2782 forbids compression of the target
+	if !bytes.HasSuffix(data, []byte("\x03sip\x07example\x03com\x00")) {
+		t.Errorf("srv target is not written in full: %x", data)
+	}
+
+	parsed, err := UnmarshalMessage(data)
+	if err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	compareRecords(t, "answer", parsed.Answer, message.Answer)
+}
+
+func TestUnmarshalMessageRejectsLongPointerChains(t *testing.T) {
+	// one record of unknown type carries a long backward chain of pointers in
+	// its RDATA, the following records have owners pointing at its end
+	const (
+		chainLength = 8000 // pointers reach only the first 16383 octets
+		pointingRRs = 100
+	)
+
+	header := NewDNSAnswerHeader()
+	header.ANCOUNT = 1 + pointingRRs
+	message := header.Marshal()
+
+	message = append(message, 0, 0, 99, 0, 1, 0, 0, 0, 0)
+	rdLengthAt := len(message)
+	message = append(message, 0, 0)
+
+	chainStart := len(message)
+	message = append(message, 1, 'a', 0)
+	previous := chainStart
+	for i := 0; i < chainLength; i++ {
+		current := len(message)
+		message = append(message, 0xC0|byte(previous>>8), byte(previous))
+		previous = current
+	}
+	rdLength := len(message) - chainStart
+	message[rdLengthAt], message[rdLengthAt+1] = byte(rdLength>>8), byte(rdLength)
+
+	for i := 0; i < pointingRRs; i++ {
+		message = append(message, 0xC0|byte(previous>>8), byte(previous), 0, 1, 0, 1, 0, 0, 0, 0, 0, 0)
+	}
+
+	_, err := UnmarshalMessage(message)
+	if !errors.Is(err, helpers.ErrTooManyPointers) {
+		t.Errorf("got %v, want %v", err, helpers.ErrTooManyPointers)
+	}
+}
+
+func TestUnmarshalMessageCopiesAddresses(t *testing.T) {
+	data := roundTripMessage().Marshal()
+
+	parsed, err := UnmarshalMessage(data)
+	if err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	for i := range data {
+		data[i] = 0
+	}
+
+	a := parsed.Answer[0].Data.(*A).Address
+	aaaa := parsed.Answer[1].Data.(*AAAA).Address
+	if a.String() != "192.0.2.1" || cap(a) > net.IPv6len {
+		t.Errorf("a record: got %s with capacity %d", a, cap(a))
+	}
+	if aaaa.String() != "2001:db8::1" || cap(aaaa) > net.IPv6len {
+		t.Errorf("aaaa record: got %s with capacity %d", aaaa, cap(aaaa))
+	}
+}
@@ -1,9 +1,10 @@
 package structures
 
 import (
+	"DNSServer/lib/helpers"
 	"bytes"
 	"encoding/binary"
-	"strings"
+	"errors"
 )
 
 // QType is a two octet code which specifies the type of the query.
@@ -32,6 +33,8 @@ const (
 	QTypeMX    // 15 mail exchange
 	QTypeTXT   // 16 text strings
 
+	QTypeAAAA = 28 // an IPv6 host address https://datatracker.ietf.org/doc/html/rfc3596
+
 	QTypeAXFR  = 252 // A request for a transfer of an entire zone
 	QTypeMAILB = 253 // A request for mailbox-related records (MB, MG or MR)
 	QTypeMAILA = 254 // A request for mail agent RRs (Obsolete - see MX)
@@ -81,25 +84,44 @@ type marshaledQuestionPacket struct {
 
 func (question *DNSQuestion) Marshal() (res []byte) {
 	buffer := new(bytes.Buffer)
+	question.marshalTo(buffer, nil)
+
+	res = buffer.Bytes()
+	return
+}
 
-	writeQName(buffer, question.QName)
+// marshalTo writes question to the buffer which holds the message from its start,
+// QName is remembered in namesPositions for compression of the following names.
+func (question *DNSQuestion) marshalTo(buffer *bytes.Buffer, namesPositions map[string]int) {
+	helpers.WriteCompressedLabel(buffer, question.QName, namesPositions)
 
 	_ = binary.Write(buffer, binary.BigEndian, uint16(question.QType))
 	_ = binary.Write(buffer, binary.BigEndian, uint16(question.QClass))
-
-	res = buffer.Bytes()
-	return
 }
 
-func UnmarshalQuestions(questionStartData []byte, questionsCount int) (questions []*DNSQuestion, unparsedData []byte) {
-	buffer := bytes.NewBuffer(questionStartData)
+// ErrTruncatedQuestion is returned when the question section ends before QTYPE and QCLASS
+var ErrTruncatedQuestion = errors.New("question is truncated")
+
+func UnmarshalQuestions(questionStartData, fullMessage []byte, questionsCount int) (
+	questions []*DNSQuestion, unparsedData []byte, err error) {
+	offset := len(fullMessage) - len(questionStartData)
 
 	for questionsCount > 0 {
-		fullLabel := parseLabel(buffer)
+		fullLabel, nextOffset, err := helpers.ReadName(fullMessage, offset)
+		if err != nil {
+			return questions, nil, err
+		}
+		offset = nextOffset
 
-		flagsReader := bytes.NewReader(buffer.Next(4))
 		var packet marshaledQuestionPacket
+		packetLength := binary.Size(packet)
+		if offset+packetLength > len(fullMessage) {
+			return questions, nil, ErrTruncatedQuestion
+		}
+
+		flagsReader := bytes.NewReader(fullMessage[offset : offset+packetLength])
 		_ = binary.Read(flagsReader, binary.BigEndian, &packet)
+		offset += packetLength
 
 		questions = append(questions, &DNSQuestion{
 			QName:  fullLabel,
@@ -109,39 +131,6 @@ func UnmarshalQuestions(questionStartData []byte, questionsCount int) (questions
 		questionsCount -= 1
 	}
 
-	unparsedData = buffer.Bytes()
-	return
-}
-
-func writeQName(buffer *bytes.Buffer, qName string) {
-	labels := strings.Split(qName, ".")
-	for _, label := range labels {
-		buffer.WriteByte(uint8(len(label)))
-		buffer.WriteString(label)
-	}
-	buffer.WriteByte(0)
-}
-
-func parseLabel(buffer *bytes.Buffer) (label string) {
-	var (
-		lengthOfCurrentLabel uint8
-		currentLabel         string
-		labels               []string
-	)
-
-	for {
-		lengthOfCurrentLabel, _ = buffer.ReadByte()
-		if lengthOfCurrentLabel == 0 {
-			break
-		}
-
-		labelBytes := make([]byte, lengthOfCurrentLabel)
-		_, _ = buffer.Read(labelBytes)
-
-		currentLabel = string(labelBytes)
-		labels = append(labels, currentLabel)
-	}
-
-	label = strings.Join(labels, ".")
+	unparsedData = fullMessage[offset:]
 	return
 }
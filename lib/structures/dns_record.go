@@ -4,8 +4,8 @@ import (
 	"DNSServer/lib/helpers"
 	"bytes"
 	"encoding/binary"
-	"strconv"
-	"strings"
+	"errors"
+	"fmt"
 )
 
 // RecordType  two octets containing one of the RR TYPE codes.
@@ -31,8 +31,10 @@ const (
 	RecordTypeMX    // 15 mail exchange
 	RecordTypeTXT   // 16 text strings
 
-	RecordTypeAAAA = 28
-	RecordTypeOPT  = 41
+	RecordTypeAAAA = 28  // https://datatracker.ietf.org/doc/html/rfc3596
+	RecordTypeSRV  = 33  // https://datatracker.ietf.org/doc/html/rfc2782
+	RecordTypeOPT  = 41  // https://datatracker.ietf.org/doc/html/rfc6891
+	RecordTypeCAA  = 257 // https://datatracker.ietf.org/doc/html/rfc8659
 )
 
 type RecordClass uint16
@@ -75,20 +77,33 @@ type DNSRecord struct {
 
 	// Here I store parsed correctly RDATA based on record Type
 	RDataRepresentation string
-}
 
-type marshaledRecordPacket struct {
-	_    byte
-	Type byte
+	// Typed RDATA, nil for types which are not parsed.
+	// When set, it is used by Marshal instead of RDATA.
+	Data RData
+}
 
-	_     byte
-	Class byte
+func NewDNSRecord(name string, class RecordClass, timeToLive uint32, data RData) *DNSRecord {
+	return &DNSRecord{
+		Name:                name,
+		Type:                data.Type(),
+		Class:               class,
+		TimeToLive:          timeToLive,
+		RDataRepresentation: data.String(),
+		Data:                data,
+	}
+}
 
+type marshaledRecordPacket struct {
+	Type     uint16
+	Class    uint16
 	TTL      uint32
 	RDLength uint16
 }
 
-func (r *DNSRecord) Marshal(namesPositions map[string]int) (res []byte) {
+// Marshal writes the record on its own, without name compression.
+// Records inside of a message are compressed by DNSMessage.Marshal.
+func (r *DNSRecord) Marshal() (res []byte) {
 	//                                1  1  1  1  1  1
 	//      0  1  2  3  4  5  6  7  8  9  0  1  2  3  4  5
 	//    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
@@ -111,40 +126,70 @@ func (r *DNSRecord) Marshal(namesPositions map[string]int) (res []byte) {
 	//    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
 
 	buffer := new(bytes.Buffer)
+	r.marshalTo(buffer, nil)
+
+	res = buffer.Bytes()
+	return res
+}
 
-	helpers.WriteLabel(buffer, r.Name)
+// marshalTo writes record to the buffer which holds the message from its start,
+// so names of the record could be compressed against names already written.
+func (r *DNSRecord) marshalTo(buffer *bytes.Buffer, namesPositions map[string]int) {
+	helpers.WriteCompressedLabel(buffer, r.Name, namesPositions)
 
 	_ = binary.Write(buffer, binary.BigEndian, uint16(r.Type))
 	_ = binary.Write(buffer, binary.BigEndian, uint16(r.Class))
 	_ = binary.Write(buffer, binary.BigEndian, r.TimeToLive)
-	_ = binary.Write(buffer, binary.BigEndian, r.RDLENGTH)
 
-	buffer.Write(r.RDATA)
+	if r.Data == nil {
+		_ = binary.Write(buffer, binary.BigEndian, uint16(len(r.RDATA)))
+		buffer.Write(r.RDATA)
+		return
+	}
 
-	res = buffer.Bytes()
-	return res
+	// RDLENGTH is known only after RDATA is written with compressed names
+	rdLengthPosition := buffer.Len()
+	_ = binary.Write(buffer, binary.BigEndian, uint16(0))
+
+	r.Data.marshal(buffer, namesPositions)
+
+	rdLength := buffer.Len() - rdLengthPosition - 2
+	binary.BigEndian.PutUint16(buffer.Bytes()[rdLengthPosition:], uint16(rdLength))
 }
 
-func UnmarshalRecords(recordsStartBytes, fullMessage []byte, recordsCount int) (records []*DNSRecord, unreadData []byte) {
-	buffer := bytes.NewBuffer(recordsStartBytes)
+var (
+	// ErrTruncatedRecord is returned when a record ends before its RDLENGTH field
+	ErrTruncatedRecord = errors.New("resource record is truncated")
 
-	for recordsCount > 0 {
-		name, shouldUnreadByte := helpers.ReadLabel(buffer, fullMessage)
+	// ErrRDLengthOverrun is returned when RDLENGTH points past the end of message
+	ErrRDLengthOverrun = errors.New("rdlength runs past the end of message")
+)
+
+func UnmarshalRecords(recordsStartBytes, fullMessage []byte, recordsCount int) (
+	records []*DNSRecord, unreadData []byte, err error) {
+	offset := len(fullMessage) - len(recordsStartBytes)
 
-		if shouldUnreadByte {
-			_ = buffer.UnreadByte()
+	for recordsCount > 0 {
+		name, nextOffset, err := helpers.ReadName(fullMessage, offset)
+		if err != nil {
+			return records, nil, err
 		}
+		offset = nextOffset
 
 		var packet marshaledRecordPacket
+		packetLength := binary.Size(packet)
+		if offset+packetLength > len(fullMessage) {
+			return records, nil, ErrTruncatedRecord
+		}
 
-		foo := make([]byte, 2+2+4+2)
-		_, _ = buffer.Read(foo)
-
-		packetReader := bytes.NewReader(foo)
+		packetReader := bytes.NewReader(fullMessage[offset : offset+packetLength])
 		_ = binary.Read(packetReader, binary.BigEndian, &packet)
+		offset += packetLength
 
-		rdata := make([]byte, packet.RDLength)
-		_, _ = buffer.Read(rdata)
+		rdataLength := int(packet.RDLength)
+		if offset+rdataLength > len(fullMessage) {
+			return records, nil, ErrRDLengthOverrun
+		}
 
 		currentRecord := &DNSRecord{
 			Name:       name,
@@ -152,43 +197,27 @@ func UnmarshalRecords(recordsStartBytes, fullMessage []byte, recordsCount int) (
 			Class:      RecordClass(packet.Class),
 			TimeToLive: packet.TTL,
 			RDLENGTH:   packet.RDLength,
-			RDATA:      rdata,
+			RDATA:      append([]byte(nil), fullMessage[offset:offset+rdataLength]...),
+		}
+
+		data, err := unmarshalRData(currentRecord.Type, fullMessage, offset, rdataLength)
+		if err != nil {
+			return records, nil, fmt.Errorf("record %s type %d: %w", name, currentRecord.Type, err)
 		}
+		offset += rdataLength
 
-		var rDataRepresentation string
-		switch currentRecord.Type {
-		case RecordTypeA:
-			rDataRepresentation = unmarshalRDataAsIpv4Address(currentRecord)
-		case RecordTypeNS:
-			rDataRepresentation = unmarshalRDataAsNS(currentRecord, fullMessage)
-		case RecordTypeOPT, RecordTypeAAAA:
-		default:
-			rDataRepresentation = "not parsed"
+		if data != nil {
+			currentRecord.Data = data
+			currentRecord.RDataRepresentation = data.String()
+		} else {
+			currentRecord.RDataRepresentation = "not parsed"
 		}
 
-		currentRecord.RDataRepresentation = rDataRepresentation
 		records = append(records, currentRecord)
 
 		recordsCount -= 1
 	}
 
-	unreadData = buffer.Bytes()
+	unreadData = fullMessage[offset:]
 	return
 }
-
-func unmarshalRDataAsIpv4Address(r *DNSRecord) string {
-	numbers := make([]string, 4)
-
-	for i, octet := range r.RDATA {
-		numbers[i] = strconv.Itoa(int(octet))
-	}
-
-	return strings.Join(numbers, ".")
-}
-
-func unmarshalRDataAsNS(r *DNSRecord, fullMessage []byte) string {
-	buffer := bytes.NewBuffer(r.RDATA)
-	name, _ := helpers.ReadLabel(buffer, fullMessage)
-
-	return name
-}
@@ -0,0 +1,168 @@
+package structures
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Extended response codes, they do not fit into 4 bits of the header RCODE
+// https://datatracker.ietf.org/doc/html/rfc6891#section-9
+const (
+	RCodeBadVersion = 16 // Bad OPT Version
+)
+
+// EDNSVersion is the only version of EDNS specified so far
+const EDNSVersion = 0
+
+// MinUDPPayloadSize is the size every dns message sent over udp has to fit in,
+// values lower than it in OPT are treated as it.
+const MinUDPPayloadSize = 512
+
+// ErrMultipleOPT is returned when message has more than one OPT pseudo-RR
+var ErrMultipleOPT = errors.New("message contains more than one OPT record")
+
+// EDNSOption is one {attribute, value} pair from the OPT variable part
+// https://datatracker.ietf.org/doc/html/rfc6891#section-6.1.2
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// OPT is RDATA of the OPT pseudo-RR, the fixed part of the record
+// (payload size, flags and version) lives in its CLASS and TTL, see EDNS.
+type OPT struct {
+	Options []EDNSOption
+}
+
+func (o *OPT) Type() RecordType { return RecordTypeOPT }
+
+func (o *OPT) String() string {
+	codes := make([]string, len(o.Options))
+	for i, option := range o.Options {
+		codes[i] = fmt.Sprintf("%d:%x", option.Code, option.Data)
+	}
+	return fmt.Sprint(codes)
+}
+
+func (o *OPT) marshal(buffer *bytes.Buffer, _ map[string]int) {
+	for _, option := range o.Options {
+		_ = binary.Write(buffer, binary.BigEndian, option.Code)
+		_ = binary.Write(buffer, binary.BigEndian, uint16(len(option.Data)))
+		buffer.Write(option.Data)
+	}
+}
+
+func (r *rdataReader) ednsOptions() (options []EDNSOption) {
+	for r.err == nil && r.position < r.end {
+		code := r.uint16()
+		length := r.uint16()
+		data := r.next(int(length))
+		if r.err == nil {
+			options = append(options, EDNSOption{Code: code, Data: append([]byte(nil), data...)})
+		}
+	}
+	return
+}
+
+// EDNS is the parsed OPT pseudo-RR as specified in
+// https://datatracker.ietf.org/doc/html/rfc6891#section-6.1.3
+//
+//	           +0 (MSB)                            +1 (LSB)
+//	+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//	|         EXTENDED-RCODE        |            VERSION            |
+//	+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+//	| DO|                           Z                               |
+//	+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+type EDNS struct {
+	// Requestor's UDP payload size, stored in CLASS of the record
+	UDPPayloadSize uint16
+
+	// Upper 8 bits of extended 12-bit RCODE
+	ExtendedRCODE uint8
+
+	Version uint8
+
+	// DNSSEC OK bit https://datatracker.ietf.org/doc/html/rfc3225
+	DO bool
+
+	Options []EDNSOption
+}
+
+func NewEDNS(udpPayloadSize uint16) *EDNS {
+	return &EDNS{UDPPayloadSize: udpPayloadSize, Version: EDNSVersion}
+}
+
+// EDNS returns parsed OPT record of the message or nil if message has none
+func (m *DNSMessage) EDNS() (*EDNS, error) {
+	var found *DNSRecord
+	for _, record := range m.Additional {
+		if record.Type != RecordTypeOPT {
+			continue
+		}
+		if found != nil {
+			return nil, ErrMultipleOPT
+		}
+		found = record
+	}
+
+	if found == nil {
+		return nil, nil
+	}
+
+	edns := &EDNS{
+		UDPPayloadSize: uint16(found.Class),
+		ExtendedRCODE:  uint8(found.TimeToLive >> 24),
+		Version:        uint8(found.TimeToLive >> 16),
+		DO:             found.TimeToLive&(1<<15) != 0,
+	}
+	if opt, ok := found.Data.(*OPT); ok {
+		edns.Options = opt.Options
+	}
+
+	return edns, nil
+}
+
+// SetEDNS replaces OPT record of the message with edns, nil edns only removes it
+func (m *DNSMessage) SetEDNS(edns *EDNS) {
+	var additional []*DNSRecord
+	for _, record := range m.Additional {
+		if record.Type != RecordTypeOPT {
+			additional = append(additional, record)
+		}
+	}
+
+	if edns != nil {
+		additional = append(additional, edns.Record())
+	}
+	m.Additional = additional
+}
+
+// RCode returns full 12-bit response code of the message
+func (m *DNSMessage) RCode() int {
+	rcode := int(m.Header.RCODE)
+	if edns, _ := m.EDNS(); edns != nil {
+		rcode |= int(edns.ExtendedRCODE) << 4
+	}
+	return rcode
+}
+
+// Record makes OPT pseudo-RR, its owner name is always root
+func (e *EDNS) Record() *DNSRecord {
+	timeToLive := uint32(e.ExtendedRCODE)<<24 | uint32(e.Version)<<16
+	if e.DO {
+		timeToLive |= 1 << 15
+	}
+
+	record := NewDNSRecord("", RecordClass(e.UDPPayloadSize), timeToLive, &OPT{Options: e.Options})
+	return record
+}
+
+// PayloadSize returns the size of udp answers the requestor is able to receive
+func (e *EDNS) PayloadSize() int {
+	if e == nil || e.UDPPayloadSize < MinUDPPayloadSize {
+		return MinUDPPayloadSize
+	}
+	return int(e.UDPPayloadSize)
+}
@@ -1,70 +1,415 @@
 package structures
 
 import (
-	"fmt"
+	"container/list"
+	"encoding/binary"
+	"hash/maphash"
 	"log"
+	"strings"
 	"sync"
 	"time"
 )
 
+// approximate memory taken by one cached record and one cache entry besides their strings
+const (
+	recordOverhead = 96
+	entryOverhead  = 128
+)
+
+const (
+	// maxCacheShards is how many independently locked parts the cache is split into at most,
+	// it has to be a power of two
+	maxCacheShards = 64
+
+	// the cache is split into fewer shards when limits are small, so each of
+	// them is still able to keep a useful number of entries
+	minShardEntries = 64
+	minShardBytes   = 64 << 10
+)
+
+// QueryCache keeps answers by question. It is bounded both by the number of
+// entries and by their approximate size in bytes, least recently used
+// entries are evicted when a limit is exceeded. Zero limit means no limit.
+//
+// The cache is split into shards chosen by hash of the key, each with its own
+// lock, so lookups of different questions do not wait for each other. Limits
+// are divided between the shards, so the cache never goes over them, but an
+// entry could be evicted while other shards still have room. Recency is
+// tracked in every shard separately, so eviction is least recently used only
+// approximately.
 type QueryCache struct {
+	seed   maphash.Seed
+	shards []*cacheShard
+}
+
+// cacheShard is one part of the cache, all its fields are guarded by mutex
+type cacheShard struct {
 	mutex sync.Mutex
-	items map[string]retrievedAnswer
+	items map[string]*list.Element
+
+	// front is the most recently used entry
+	recentlyUsed *list.List
+
+	maxEntries int
+	maxBytes   int
+	bytes      int
+
+	hits         uint64
+	negativeHits uint64
+	misses       uint64
+	evictions    uint64
+	expirations  uint64
 }
 
-func NewQueryCache() *QueryCache {
-	return &QueryCache{
-		items: make(map[string]retrievedAnswer),
+// CacheStatistics is the state of the cache and counters of its events
+type CacheStatistics struct {
+	Entries int
+	Bytes   int
+
+	Hits         uint64
+	NegativeHits uint64
+
+	// Misses counts lookups of positive answers which were not found
+	Misses uint64
+
+	// Evictions counts entries removed before expiration because of the limits
+	Evictions uint64
+
+	// Expirations counts entries removed because of their TTL
+	Expirations uint64
+}
+
+func NewQueryCache(maxEntries, maxBytes int) *QueryCache {
+	return newShardedQueryCache(maxEntries, maxBytes, shardsCount(maxEntries, maxBytes))
+}
+
+// newShardedQueryCache makes cache of shards parts, shards has to be a power of two
+func newShardedQueryCache(maxEntries, maxBytes, shards int) *QueryCache {
+	q := &QueryCache{seed: maphash.MakeSeed(), shards: make([]*cacheShard, shards)}
+	for i := range q.shards {
+		q.shards[i] = &cacheShard{
+			items:        make(map[string]*list.Element),
+			recentlyUsed: list.New(),
+			maxEntries:   maxEntries / shards,
+			maxBytes:     maxBytes / shards,
+		}
 	}
+	return q
+}
+
+// shardsCount is the number of shards each of which gets at least
+// minShardEntries and minShardBytes of the limits, one shard gets limits whole
+func shardsCount(maxEntries, maxBytes int) int {
+	shards := maxCacheShards
+	for shards > 1 && ((maxEntries > 0 && maxEntries/shards < minShardEntries) ||
+		(maxBytes > 0 && maxBytes/shards < minShardBytes)) {
+		shards /= 2
+	}
+	return shards
+}
+
+// shard returns the part of the cache key belongs to
+func (q *QueryCache) shard(key string) *cacheShard {
+	var hash maphash.Hash
+	hash.SetSeed(q.seed)
+	_, _ = hash.WriteString(key)
+	return q.shards[hash.Sum64()&uint64(len(q.shards)-1)]
+}
+
+type cacheEntry struct {
+	key    string
+	answer retrievedAnswer
+	size   int
 }
 
 type retrievedAnswer struct {
 	answers     []*DNSRecord
 	retrievedAt time.Time
+	credibility Credibility
+
+	// the time after which nothing of the answer could be used
+	expiresAt time.Time
+
+	// Negative answers https://datatracker.ietf.org/doc/html/rfc2308
+	// keep rcode (NXDOMAIN or NOERROR for NODATA) and SOA of the zone
+	// which has said that there is no data.
+	negative    bool
+	rcode       byte
+	soa         *DNSRecord
+	negativeTTL uint32
 }
 
 func (q *QueryCache) Get(question *DNSQuestion) ([]*DNSRecord, bool) {
-	questionString := makeQuestionString(question)
+	key := makeQuestionString(question)
+	shard := q.shard(key)
+	now := time.Now()
 
-	q.mutex.Lock()
-	retrieved, ok := q.items[questionString]
-	q.mutex.Unlock()
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
 
-	if !ok {
+	retrieved, ok := shard.lookup(key, now)
+	if !ok || retrieved.negative {
+		shard.misses += 1
 		return nil, false
 	}
 
-	var totalAnswers []*DNSRecord
-	currentTime := time.Now()
-	for _, answer := range retrieved.answers {
-		timeToLive := int(answer.TimeToLive)
-		if retrieved.retrievedAt.Add(time.Second * time.Duration(timeToLive)).After(currentTime) {
-			totalAnswers = append(totalAnswers, answer)
-		}
-	}
-
+	totalAnswers := retrieved.unexpiredAnswers(now)
 	if totalAnswers != nil {
+		shard.hits += 1
 		return totalAnswers, true
 	}
 
+	shard.misses += 1
 	return nil, false
 }
 
-func (q *QueryCache) Set(question *DNSQuestion, answers []*DNSRecord) {
+// Set caches answers for the question, unless answers with higher credibility are cached already
+func (q *QueryCache) Set(question *DNSQuestion, answers []*DNSRecord, credibility Credibility) {
 	retrivedAt := time.Now()
 	item := retrievedAnswer{
 		answers:     answers,
 		retrievedAt: retrivedAt,
+		credibility: credibility,
+		expiresAt:   retrivedAt,
+	}
+	for _, answer := range answers {
+		answerExpiresAt := retrivedAt.Add(time.Second * time.Duration(answer.TimeToLive))
+		if answerExpiresAt.After(item.expiresAt) {
+			item.expiresAt = answerExpiresAt
+		}
+	}
+	key := makeQuestionString(question)
+	shard := q.shard(key)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	cached, ok := shard.lookup(key, retrivedAt)
+	if ok && !cached.negative && cached.credibility > credibility && cached.unexpiredAnswers(retrivedAt) != nil {
+		log.Printf("not replacing cached answer for %s with less credible one", question.QName)
+		return
+	}
+	shard.store(key, item)
+}
+
+func (r retrievedAnswer) unexpiredAnswers(currentTime time.Time) (totalAnswers []*DNSRecord) {
+	for _, answer := range r.answers {
+		timeToLive := int(answer.TimeToLive)
+		if r.retrievedAt.Add(time.Second * time.Duration(timeToLive)).After(currentTime) {
+			totalAnswers = append(totalAnswers, answer)
+		}
+	}
+	return
+}
+
+// GetNegative returns cached NXDOMAIN or NODATA for the question. NXDOMAIN
+// is returned for any type of the name, NODATA only for the type it was
+// received for. soa is a copy with TTL decreased by the time spent in cache.
+func (q *QueryCache) GetNegative(question *DNSQuestion) (rcode byte, soa *DNSRecord, ok bool) {
+	now := time.Now()
+
+	// the two keys could be in different shards, so they are looked up one after another
+	for _, key := range []string{makeNameString(question), makeQuestionString(question)} {
+		if rcode, soa, ok = q.shard(key).getNegative(key, now); ok {
+			return
+		}
+	}
+	return 0, nil, false
+}
+
+// SetNegative caches NXDOMAIN (rcode RCodeNameError) or NODATA (rcode RCodeNoError)
+// answer for the question for the negative TTL taken from soa
+// https://datatracker.ietf.org/doc/html/rfc2308#section-5
+func (q *QueryCache) SetNegative(question *DNSQuestion, rcode byte, soa *DNSRecord) {
+	retrievedAt := time.Now()
+	item := retrievedAnswer{
+		retrievedAt: retrievedAt,
+		negative:    true,
+		rcode:       rcode,
+		soa:         soa,
+		negativeTTL: NegativeTTL(soa),
 	}
-	questionString := makeQuestionString(question)
+	item.expiresAt = retrievedAt.Add(time.Second * time.Duration(item.negativeTTL))
 
-	q.mutex.Lock()
-	q.items[questionString] = item
-	q.mutex.Unlock()
+	key := makeQuestionString(question)
+	if rcode == RCodeNameError {
+		key = makeNameString(question)
+	}
+	shard := q.shard(key)
+
+	shard.mutex.Lock()
+	shard.store(key, item)
+	shard.mutex.Unlock()
+}
+
+// RemoveExpired deletes entries nothing of which could be used anymore, it returns how many were deleted.
+// Shards are swept one by one, so lookups are blocked only in the shard being swept.
+func (q *QueryCache) RemoveExpired() int {
+	removed := 0
+	for _, shard := range q.shards {
+		removed += shard.removeExpired(time.Now())
+	}
+	return removed
+}
+
+// Statistics sums the state and counters of all shards
+func (q *QueryCache) Statistics() (statistics CacheStatistics) {
+	for _, shard := range q.shards {
+		shard.mutex.Lock()
+		statistics.Entries += len(shard.items)
+		statistics.Bytes += shard.bytes
+		statistics.Hits += shard.hits
+		statistics.NegativeHits += shard.negativeHits
+		statistics.Misses += shard.misses
+		statistics.Evictions += shard.evictions
+		statistics.Expirations += shard.expirations
+		shard.mutex.Unlock()
+	}
+	return
+}
+
+func (s *cacheShard) getNegative(key string, now time.Time) (rcode byte, soa *DNSRecord, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	retrieved, found := s.lookup(key, now)
+	if !found || !retrieved.negative {
+		return 0, nil, false
+	}
+
+	spent := uint32(now.Sub(retrieved.retrievedAt) / time.Second)
+	if spent >= retrieved.negativeTTL {
+		return 0, nil, false
+	}
+
+	s.negativeHits += 1
+	soaCopy := *retrieved.soa
+	soaCopy.TimeToLive = retrieved.negativeTTL - spent
+	return retrieved.rcode, &soaCopy, true
+}
+
+func (s *cacheShard) removeExpired(now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	removed := 0
+	for element := s.recentlyUsed.Back(); element != nil; {
+		previous := element.Prev()
+		if entry := element.Value.(*cacheEntry); !entry.answer.expiresAt.After(now) {
+			s.remove(element)
+			s.expirations += 1
+			removed += 1
+		}
+		element = previous
+	}
+	return removed
+}
+
+// lookup returns entry of key and marks it as recently used, expired entry is deleted.
+// s.mutex has to be held.
+func (s *cacheShard) lookup(key string, now time.Time) (retrievedAnswer, bool) {
+	element, ok := s.items[key]
+	if !ok {
+		return retrievedAnswer{}, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if !entry.answer.expiresAt.After(now) {
+		s.remove(element)
+		s.expirations += 1
+		return retrievedAnswer{}, false
+	}
+
+	s.recentlyUsed.MoveToFront(element)
+	return entry.answer, true
 }
 
+// store puts answer under key and evicts least recently used entries
+// while the shard is over its limits. s.mutex has to be held.
+func (s *cacheShard) store(key string, answer retrievedAnswer) {
+	if element, ok := s.items[key]; ok {
+		s.remove(element)
+	}
+
+	entry := &cacheEntry{key: key, answer: answer, size: entrySize(key, answer)}
+	s.items[key] = s.recentlyUsed.PushFront(entry)
+	s.bytes += entry.size
+
+	for s.overLimits() {
+		oldest := s.recentlyUsed.Back()
+		if oldest == nil {
+			return
+		}
+		s.remove(oldest)
+		s.evictions += 1
+	}
+}
+
+func (s *cacheShard) overLimits() bool {
+	return (s.maxEntries > 0 && len(s.items) > s.maxEntries) || (s.maxBytes > 0 && s.bytes > s.maxBytes)
+}
+
+// remove has to be called with s.mutex held
+func (s *cacheShard) remove(element *list.Element) {
+	entry := s.recentlyUsed.Remove(element).(*cacheEntry)
+	delete(s.items, entry.key)
+	s.bytes -= entry.size
+}
+
+// entrySize approximates memory taken by the entry
+func entrySize(key string, answer retrievedAnswer) int {
+	size := entryOverhead + len(key)
+	for _, record := range answer.answers {
+		size += recordSize(record)
+	}
+	if answer.soa != nil {
+		size += recordSize(answer.soa)
+	}
+	return size
+}
+
+func recordSize(record *DNSRecord) int {
+	return recordOverhead + len(record.Name) + len(record.RDATA) + len(record.RDataRepresentation)
+}
+
+// NegativeTTL is the time negative answer could be cached for, it is the
+// minimum of the SOA record TTL and SOA MINIMUM field
+func NegativeTTL(soa *DNSRecord) uint32 {
+	ttl := soa.TimeToLive
+	if soaData, ok := soa.Data.(*SOA); ok && soaData.Minimum < ttl {
+		ttl = soaData.Minimum
+	}
+	return ttl
+}
+
+// makeQuestionString is the key of the question, names are case-insensitive
+// https://datatracker.ietf.org/doc/html/rfc4343
+// The type and class are appended as fixed size suffix, so keys of different
+// questions never collide and no formatting is done on the lookup path.
 func makeQuestionString(question *DNSQuestion) string {
-	str := fmt.Sprintf("%s-%b-%b", question.QName, question.QType, question.QClass)
-	log.Println(str)
-	return str
+	return makeKey(question.QName, keyKindQuestion, uint16(question.QType), uint16(question.QClass))
+}
+
+// makeNameString is the key of NXDOMAIN, it does not depend on the type
+func makeNameString(question *DNSQuestion) string {
+	return makeKey(question.QName, keyKindName, 0, uint16(question.QClass))
+}
+
+// kinds of keys, they keep NXDOMAIN of a name apart from answers of its types
+const (
+	keyKindQuestion = 'q'
+	keyKindName     = 'n'
+)
+
+func makeKey(name string, kind byte, qType, qClass uint16) string {
+	// strings.ToLower returns name itself when there is nothing to lower
+	name = strings.ToLower(name)
+
+	key := make([]byte, len(name)+5)
+	copy(key, name)
+	suffix := key[len(name):]
+	suffix[0] = kind
+	binary.BigEndian.PutUint16(suffix[1:], qType)
+	binary.BigEndian.PutUint16(suffix[3:], qClass)
+	return string(key)
 }
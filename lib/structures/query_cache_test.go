@@ -0,0 +1,147 @@
+package structures
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func cacheTestQuestion(i int) *DNSQuestion {
+	return NewDNSQuestion(fmt.Sprintf("host%d.example.com", i), 1, 1)
+}
+
+func cacheTestAnswer(question *DNSQuestion) []*DNSRecord {
+	return []*DNSRecord{NewDNSRecord(question.QName, RecordClassIN, 3600, &A{Address: net.ParseIP("192.0.2.1").To4()})}
+}
+
+func TestQueryCacheKeepsSmallLimits(t *testing.T) {
+	for _, maxEntries := range []int{1, 10, 100, 1000, 100000} {
+		cache := NewQueryCache(maxEntries, 0)
+		for i := 0; i < 2*maxEntries+100; i++ {
+			question := cacheTestQuestion(i)
+			cache.Set(question, cacheTestAnswer(question), CredibilityAuthAnswer)
+		}
+
+		if entries := cache.Statistics().Entries; entries > maxEntries {
+			t.Errorf("limit %d: cache has %d entries", maxEntries, entries)
+		}
+	}
+
+	cache := NewQueryCache(0, 4096)
+	for i := 0; i < 100; i++ {
+		question := cacheTestQuestion(i)
+		cache.Set(question, cacheTestAnswer(question), CredibilityAuthAnswer)
+	}
+	if bytes := cache.Statistics().Bytes; bytes > 4096 {
+		t.Errorf("limit 4096: cache takes %d bytes", bytes)
+	}
+}
+
+func TestQueryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewQueryCache(3, 0)
+	for i := 0; i < 3; i++ {
+		question := cacheTestQuestion(i)
+		cache.Set(question, cacheTestAnswer(question), CredibilityAuthAnswer)
+	}
+
+	cache.Get(cacheTestQuestion(0))
+	question := cacheTestQuestion(3)
+	cache.Set(question, cacheTestAnswer(question), CredibilityAuthAnswer)
+
+	for i, want := range []bool{true, false, true, true} {
+		if _, ok := cache.Get(cacheTestQuestion(i)); ok != want {
+			t.Errorf("entry %d: cached %v, want %v", i, ok, want)
+		}
+	}
+	if evictions := cache.Statistics().Evictions; evictions != 1 {
+		t.Errorf("got %d evictions, want 1", evictions)
+	}
+}
+
+// cacheVariants are caches benchmarks are run with, the single lock one is
+// how the cache worked before it was sharded
+var cacheVariants = []struct {
+	name   string
+	shards int
+}{
+	{"sharded", maxCacheShards},
+	{"single lock", 1},
+}
+
+const benchmarkQuestions = 4096
+
+func benchmarkQuestionsSet() []*DNSQuestion {
+	questions := make([]*DNSQuestion, benchmarkQuestions)
+	for i := range questions {
+		questions[i] = cacheTestQuestion(i)
+	}
+	return questions
+}
+
+// run with -cpu 1,2,4,8 to see how throughput scales across cores
+func BenchmarkQueryCacheGet(b *testing.B) {
+	questions := benchmarkQuestionsSet()
+
+	for _, variant := range cacheVariants {
+		b.Run(variant.name, func(b *testing.B) {
+			cache := newShardedQueryCache(0, 0, variant.shards)
+			for _, question := range questions {
+				cache.Set(question, cacheTestAnswer(question), CredibilityAuthAnswer)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					cache.Get(questions[i%benchmarkQuestions])
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkQueryCacheSet(b *testing.B) {
+	questions := benchmarkQuestionsSet()
+	answers := make([][]*DNSRecord, len(questions))
+	for i, question := range questions {
+		answers[i] = cacheTestAnswer(question)
+	}
+
+	for _, variant := range cacheVariants {
+		b.Run(variant.name, func(b *testing.B) {
+			cache := newShardedQueryCache(benchmarkQuestions/2, 0, variant.shards)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					cache.Set(questions[i%benchmarkQuestions], answers[i%benchmarkQuestions], CredibilityAuthAnswer)
+				}
+			})
+		})
+	}
+}
+
+// mixed load of a resolver, mostly hits with some answers being replaced
+func BenchmarkQueryCacheMixed(b *testing.B) {
+	questions := benchmarkQuestionsSet()
+
+	for _, variant := range cacheVariants {
+		b.Run(variant.name, func(b *testing.B) {
+			cache := newShardedQueryCache(0, 0, variant.shards)
+			for _, question := range questions {
+				cache.Set(question, cacheTestAnswer(question), CredibilityAuthAnswer)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					question := questions[i%benchmarkQuestions]
+					if i%10 == 0 {
+						cache.Set(question, cacheTestAnswer(question), CredibilityAuthAnswer)
+					} else {
+						cache.Get(question)
+					}
+				}
+			})
+		})
+	}
+}
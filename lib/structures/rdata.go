@@ -0,0 +1,360 @@
+package structures
+
+import (
+	"DNSServer/lib/helpers"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrMalformedRData is returned when RDATA does not match the format of its type
+var ErrMalformedRData = errors.New("rdata is malformed")
+
+// RData is a parsed RDATA field of a resource record.
+// Implementations are stored in DNSRecord.Data and are used by DNSRecord.Marshal
+// instead of raw RDATA bytes.
+type RData interface {
+	// Type returns record type which this data belongs to.
+	Type() RecordType
+
+	// String returns data in zone file (presentation) format.
+	String() string
+
+	// marshal writes data to buffer, names are compressed with namesPositions
+	// (see helpers.WriteCompressedLabel) if the type allows it.
+	marshal(buffer *bytes.Buffer, namesPositions map[string]int)
+}
+
+// A https://datatracker.ietf.org/doc/html/rfc1035#section-3.4.1
+type A struct {
+	Address net.IP
+}
+
+func (a *A) Type() RecordType { return RecordTypeA }
+
+func (a *A) String() string { return a.Address.String() }
+
+func (a *A) marshal(buffer *bytes.Buffer, _ map[string]int) {
+	buffer.Write(a.Address.To4())
+}
+
+// AAAA https://datatracker.ietf.org/doc/html/rfc3596#section-2.2
+type AAAA struct {
+	Address net.IP
+}
+
+func (a *AAAA) Type() RecordType { return RecordTypeAAAA }
+
+func (a *AAAA) String() string { return a.Address.String() }
+
+func (a *AAAA) marshal(buffer *bytes.Buffer, _ map[string]int) {
+	buffer.Write(a.Address.To16())
+}
+
+// NS https://datatracker.ietf.org/doc/html/rfc1035#section-3.3.11
+type NS struct {
+	Host string
+}
+
+func (n *NS) Type() RecordType { return RecordTypeNS }
+
+func (n *NS) String() string { return n.Host }
+
+func (n *NS) marshal(buffer *bytes.Buffer, namesPositions map[string]int) {
+	helpers.WriteCompressedLabel(buffer, n.Host, namesPositions)
+}
+
+// CNAME https://datatracker.ietf.org/doc/html/rfc1035#section-3.3.1
+type CNAME struct {
+	Target string
+}
+
+func (c *CNAME) Type() RecordType { return RecordTypeCNAME }
+
+func (c *CNAME) String() string { return c.Target }
+
+func (c *CNAME) marshal(buffer *bytes.Buffer, namesPositions map[string]int) {
+	helpers.WriteCompressedLabel(buffer, c.Target, namesPositions)
+}
+
+// PTR https://datatracker.ietf.org/doc/html/rfc1035#section-3.3.12
+type PTR struct {
+	Target string
+}
+
+func (p *PTR) Type() RecordType { return RecordTypePTR }
+
+func (p *PTR) String() string { return p.Target }
+
+func (p *PTR) marshal(buffer *bytes.Buffer, namesPositions map[string]int) {
+	helpers.WriteCompressedLabel(buffer, p.Target, namesPositions)
+}
+
+// SOA https://datatracker.ietf.org/doc/html/rfc1035#section-3.3.13
+type SOA struct {
+	// The domain-name of the name server that was the
+	// original or primary source of data for this zone.
+	MName string
+
+	// A domain-name which specifies the mailbox of the
+	// person responsible for this zone.
+	RName string
+
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+
+	// The unsigned 32 bit minimum TTL field that should be
+	// exported with any RR from this zone.
+	Minimum uint32
+}
+
+func (s *SOA) Type() RecordType { return RecordTypeSOA }
+
+func (s *SOA) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d",
+		s.MName, s.RName, s.Serial, s.Refresh, s.Retry, s.Expire, s.Minimum)
+}
+
+func (s *SOA) marshal(buffer *bytes.Buffer, namesPositions map[string]int) {
+	helpers.WriteCompressedLabel(buffer, s.MName, namesPositions)
+	helpers.WriteCompressedLabel(buffer, s.RName, namesPositions)
+	_ = binary.Write(buffer, binary.BigEndian, s.Serial)
+	_ = binary.Write(buffer, binary.BigEndian, s.Refresh)
+	_ = binary.Write(buffer, binary.BigEndian, s.Retry)
+	_ = binary.Write(buffer, binary.BigEndian, s.Expire)
+	_ = binary.Write(buffer, binary.BigEndian, s.Minimum)
+}
+
+// MX https://datatracker.ietf.org/doc/html/rfc1035#section-3.3.9
+type MX struct {
+	// Preference given to this RR among others at the same owner.
+	// Lower values are preferred.
+	Preference uint16
+
+	Exchange string
+}
+
+func (m *MX) Type() RecordType { return RecordTypeMX }
+
+func (m *MX) String() string {
+	return strconv.Itoa(int(m.Preference)) + " " + m.Exchange
+}
+
+func (m *MX) marshal(buffer *bytes.Buffer, namesPositions map[string]int) {
+	_ = binary.Write(buffer, binary.BigEndian, m.Preference)
+	helpers.WriteCompressedLabel(buffer, m.Exchange, namesPositions)
+}
+
+// TXT https://datatracker.ietf.org/doc/html/rfc1035#section-3.3.14
+type TXT struct {
+	// One or more <character-string>s, each is at most 255 octets long.
+	Strings []string
+}
+
+func (t *TXT) Type() RecordType { return RecordTypeTXT }
+
+func (t *TXT) String() string {
+	quoted := make([]string, len(t.Strings))
+	for i, str := range t.Strings {
+		quoted[i] = strconv.Quote(str)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (t *TXT) marshal(buffer *bytes.Buffer, _ map[string]int) {
+	for _, str := range t.Strings {
+		buffer.WriteByte(uint8(len(str)))
+		buffer.WriteString(str)
+	}
+}
+
+// SRV https://datatracker.ietf.org/doc/html/rfc2782
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func (s *SRV) Type() RecordType { return RecordTypeSRV }
+
+func (s *SRV) String() string {
+	return fmt.Sprintf("%d %d %d %s", s.Priority, s.Weight, s.Port, s.Target)
+}
+
+// marshal writes Target uncompressed, RFC 2782 says "name compression is not
+// to be used for this field"
+func (s *SRV) marshal(buffer *bytes.Buffer, _ map[string]int) {
+	_ = binary.Write(buffer, binary.BigEndian, s.Priority)
+	_ = binary.Write(buffer, binary.BigEndian, s.Weight)
+	_ = binary.Write(buffer, binary.BigEndian, s.Port)
+	helpers.WriteLabel(buffer, s.Target)
+}
+
+// CAA https://datatracker.ietf.org/doc/html/rfc8659#section-4.1
+type CAA struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+func (c *CAA) Type() RecordType { return RecordTypeCAA }
+
+func (c *CAA) String() string {
+	return fmt.Sprintf("%d %s %s", c.Flags, c.Tag, strconv.Quote(c.Value))
+}
+
+func (c *CAA) marshal(buffer *bytes.Buffer, _ map[string]int) {
+	buffer.WriteByte(c.Flags)
+	buffer.WriteByte(uint8(len(c.Tag)))
+	buffer.WriteString(c.Tag)
+	buffer.WriteString(c.Value)
+}
+
+// rdataReader reads fields of one RDATA. It works on the full message,
+// because names inside RDATA could point to any earlier part of it.
+type rdataReader struct {
+	fullMessage []byte
+	position    int
+	end         int
+	err         error
+}
+
+func (r *rdataReader) next(length int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if r.position+length > r.end {
+		r.err = fmt.Errorf("%w: rdata is shorter than its type requires", ErrMalformedRData)
+		return nil
+	}
+
+	data := r.fullMessage[r.position : r.position+length]
+	r.position += length
+	return data
+}
+
+func (r *rdataReader) uint8() uint8 {
+	data := r.next(1)
+	if data == nil {
+		return 0
+	}
+	return data[0]
+}
+
+func (r *rdataReader) uint16() uint16 {
+	data := r.next(2)
+	if data == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(data)
+}
+
+func (r *rdataReader) uint32() uint32 {
+	data := r.next(4)
+	if data == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(data)
+}
+
+func (r *rdataReader) name() string {
+	if r.err != nil {
+		return ""
+	}
+
+	name, nextOffset, err := helpers.ReadName(r.fullMessage[:r.end], r.position)
+	if err != nil {
+		r.err = err
+		return ""
+	}
+
+	r.position = nextOffset
+	return name
+}
+
+func (r *rdataReader) characterString() string {
+	length := r.uint8()
+	return string(r.next(int(length)))
+}
+
+func (r *rdataReader) rest() []byte {
+	return r.next(r.end - r.position)
+}
+
+// unmarshalRData parses RDATA of recordType which occupies
+// fullMessage[offset:offset+length]. Unknown types are returned as nil data.
+func unmarshalRData(recordType RecordType, fullMessage []byte, offset, length int) (data RData, err error) {
+	reader := &rdataReader{
+		fullMessage: fullMessage,
+		position:    offset,
+		end:         offset + length,
+	}
+
+	switch recordType {
+	// addresses are copied, slices of the message would keep all of it alive as long as the record
+	case RecordTypeA:
+		data = &A{Address: net.IP(append([]byte(nil), reader.next(net.IPv4len)...))}
+	case RecordTypeAAAA:
+		data = &AAAA{Address: net.IP(append([]byte(nil), reader.next(net.IPv6len)...))}
+	case RecordTypeNS:
+		data = &NS{Host: reader.name()}
+	case RecordTypeCNAME:
+		data = &CNAME{Target: reader.name()}
+	case RecordTypePTR:
+		data = &PTR{Target: reader.name()}
+	case RecordTypeSOA:
+		data = &SOA{
+			MName:   reader.name(),
+			RName:   reader.name(),
+			Serial:  reader.uint32(),
+			Refresh: reader.uint32(),
+			Retry:   reader.uint32(),
+			Expire:  reader.uint32(),
+			Minimum: reader.uint32(),
+		}
+	case RecordTypeMX:
+		data = &MX{
+			Preference: reader.uint16(),
+			Exchange:   reader.name(),
+		}
+	case RecordTypeTXT:
+		txt := &TXT{}
+		for reader.err == nil && reader.position < reader.end {
+			txt.Strings = append(txt.Strings, reader.characterString())
+		}
+		data = txt
+	case RecordTypeSRV:
+		data = &SRV{
+			Priority: reader.uint16(),
+			Weight:   reader.uint16(),
+			Port:     reader.uint16(),
+			Target:   reader.name(),
+		}
+	case RecordTypeCAA:
+		caa := &CAA{Flags: reader.uint8()}
+		caa.Tag = reader.characterString()
+		caa.Value = string(reader.rest())
+		data = caa
+	case RecordTypeOPT:
+		data = &OPT{Options: reader.ednsOptions()}
+	default:
+		return nil, nil
+	}
+
+	if reader.err != nil {
+		return nil, reader.err
+	}
+
+	if reader.position != reader.end {
+		return nil, fmt.Errorf("%w: %d octets left unparsed", ErrMalformedRData, reader.end-reader.position)
+	}
+
+	return data, nil
+}
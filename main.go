@@ -2,10 +2,151 @@ package main
 
 import (
 	"DNSServer/lib"
+	"DNSServer/lib/structures"
+	"flag"
+	"fmt"
 	"log"
+	"net"
+	"strings"
+	"time"
 )
 
 func main() {
+	ednsBufferSize := flag.Uint("edns-buffer-size", uint(lib.EDNSBufferSize),
+		"udp payload size advertised in EDNS(0) OPT records")
+	flag.IntVar(&lib.MaxTCPConnections, "tcp-max-connections", lib.MaxTCPConnections,
+		"how many tcp clients could be connected at once")
+	flag.DurationVar(&lib.TCPIdleTimeout, "tcp-idle-timeout", lib.TCPIdleTimeout,
+		"how long idle tcp connections are kept open")
+	flag.IntVar(&lib.MaxTCPQueriesPerConnection, "tcp-max-queries-per-connection", lib.MaxTCPQueriesPerConnection,
+		"how many queries of one tcp connection are resolved at once")
+	flag.DurationVar(&lib.UpstreamTimeout, "upstream-timeout", lib.UpstreamTimeout,
+		"timeout of one exchange with an upstream server")
+	flag.IntVar(&lib.UpstreamAttempts, "upstream-attempts", lib.UpstreamAttempts,
+		"how many times each upstream server is asked before moving to the next one")
+	flag.DurationVar(&lib.QueryTimeout, "query-timeout", lib.QueryTimeout,
+		"deadline for resolving one client query")
+	flag.IntVar(&lib.MaxCNAMEChainLength, "max-cname-chain", lib.MaxCNAMEChainLength,
+		"how many CNAMEs are followed for one client query")
+	flag.IntVar(&lib.MaxReferralDepth, "max-referral-depth", lib.MaxReferralDepth,
+		"how many referrals could be followed for one client query")
+	flag.IntVar(&lib.MaxUpstreamQueries, "max-upstream-queries", lib.MaxUpstreamQueries,
+		"how many upstream queries could be sent for one client query")
+	flag.IntVar(&lib.MaxGluelessLookups, "max-glueless-lookups", lib.MaxGluelessLookups,
+		"how many nameservers without glue could be resolved for one client query")
+	flag.IntVar(&lib.MaxNSFanOut, "max-ns-fan-out", lib.MaxNSFanOut,
+		"how many nameservers of one referral are used")
+	flag.IntVar(&lib.MaxParallelGluelessLookups, "max-parallel-glueless-lookups", lib.MaxParallelGluelessLookups,
+		"how many nameservers without glue of one referral are resolved at once")
+	flag.DurationVar(&lib.ServerBackoff, "server-backoff", lib.ServerBackoff,
+		"how long a failed upstream server is asked only when others fail too, doubles with every failure in a row")
+	flag.DurationVar(&lib.MaxServerBackoff, "max-server-backoff", lib.MaxServerBackoff,
+		"upper limit of the upstream server backoff")
+	forwarders := flag.String("forward", "",
+		"comma separated addresses of servers all queries are forwarded to, queries are resolved iteratively when empty")
+	flag.Var(conditionalForwarders{}, "forward-zone",
+		"zone=address[,address...] forwards queries for names in the zone, could be repeated")
+	rootHints := flag.String("root-hints", "",
+		"file with root servers in named.root format, built-in list is used when empty")
+	alternativeRoots := flag.String("root-servers", "",
+		"comma separated addresses of alternative root servers, e.g. of a private root")
+	qnameMinimisation := flag.String("qname-minimisation", "relaxed",
+		"how much of the name is sent to servers of parent zones: off, strict or relaxed")
+	listenAddresses := flag.String("listen", strings.Join(lib.ListenAddresses, ","),
+		"comma separated ipv4 and ipv6 addresses to accept queries on")
+	addressFamily := flag.String("upstream-ip", "prefer-ipv4",
+		"ip versions used to reach upstream servers: prefer-ipv4, prefer-ipv6, ipv4-only or ipv6-only")
+	flag.BoolVar(&lib.CaseRandomisation, "case-randomisation", lib.CaseRandomisation,
+		"randomise letter case of names in upstream queries (0x20 encoding) and require it echoed")
+	flag.IntVar(&lib.MaxCacheEntries, "cache-max-entries", lib.MaxCacheEntries,
+		"how many answers could be cached, 0 means no limit")
+	flag.IntVar(&lib.MaxCacheBytes, "cache-max-bytes", lib.MaxCacheBytes,
+		"approximate memory limit of cached answers, 0 means no limit")
+	flag.IntVar(&lib.MaxDelegationEntries, "delegation-cache-max-entries", lib.MaxDelegationEntries,
+		"how many zones and how many nameserver names could be in the delegation cache, 0 means no limit")
+	flag.DurationVar(&lib.CacheSweepInterval, "cache-sweep-interval", lib.CacheSweepInterval,
+		"how often expired answers and delegations are removed from the caches")
+	statisticsLogInterval := flag.Duration("log-statistics", 0,
+		"how often statistics of upstream servers, caches and deduplicated queries are logged, 0 disables it")
+	flag.Parse()
+
+	if *ednsBufferSize < structures.MinUDPPayloadSize || *ednsBufferSize > 65535 {
+		log.Fatalf("edns buffer size must be between %d and 65535", structures.MinUDPPayloadSize)
+	}
+	lib.EDNSBufferSize = uint16(*ednsBufferSize)
+
+	if lib.UpstreamAttempts < 1 {
+		log.Fatalf("upstream attempts must be at least 1")
+	}
+
+	if lib.MaxParallelGluelessLookups < 1 {
+		log.Fatalf("parallel glueless lookups must be at least 1")
+	}
+
+	if lib.MaxTCPConnections < 1 {
+		log.Fatalf("tcp connections must be at least 1")
+	}
+
+	if lib.MaxTCPQueriesPerConnection < 1 {
+		log.Fatalf("tcp queries per connection must be at least 1")
+	}
+
+	mode, err := lib.ParseQNAMEMinimisationMode(*qnameMinimisation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lib.QNAMEMinimisation = mode
+
+	listen, err := parseAddresses(*listenAddresses)
+	if err != nil {
+		log.Fatalf("bad listen addresses: %s", err)
+	}
+	lib.ListenAddresses = listen
+
+	family, err := lib.ParseAddressFamilyPreference(*addressFamily)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lib.UpstreamAddressFamily = family
+
+	if *forwarders != "" {
+		servers, err := parseAddresses(*forwarders)
+		if err != nil {
+			log.Fatalf("bad forwarders: %s", err)
+		}
+		lib.Forwarders = servers
+	}
+
+	if *rootHints != "" {
+		hints, err := lib.LoadRootHints(*rootHints)
+		if err != nil {
+			log.Fatalf("failed to load root hints: %s", err)
+		}
+		lib.RootIPServers = hints
+	}
+
+	if *alternativeRoots != "" {
+		roots, err := parseAddresses(*alternativeRoots)
+		if err != nil {
+			log.Fatalf("bad root servers: %s", err)
+		}
+		lib.RootIPServers = roots
+	}
+
+	if lib.CacheSweepInterval <= 0 {
+		log.Fatalf("cache sweep interval must be positive")
+	}
+	lib.StartCache()
+
+	// forwarders do the iteration themselves, roots are not needed then
+	if len(lib.Forwarders) == 0 {
+		go lib.KeepRootsPrimed()
+	}
+
+	if *statisticsLogInterval > 0 {
+		go logStatistics(*statisticsLogInterval)
+	}
+
 	exit := make(chan bool)
 	go lib.RequestsReceiver(exit)
 
@@ -18,3 +159,58 @@ func main() {
 	<-exit
 	log.Println("DNS Server gracefully shut down")
 }
+
+func logStatistics(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, server := range lib.ServersRTT.Snapshot() {
+			log.Printf("upstream %s srtt=%s failures=%d spoofed=%d backoff until %s", server.Address,
+				server.SRTT, server.Failures, server.SpoofedResponses, server.BackoffUntil.Format(time.RFC3339))
+		}
+		log.Printf("spoofed responses total %d", lib.SpoofedResponses())
+
+		cache := lib.CacheStatistics()
+		log.Printf("cache entries=%d bytes=%d hits=%d negative hits=%d misses=%d evictions=%d expirations=%d",
+			cache.Entries, cache.Bytes, cache.Hits, cache.NegativeHits, cache.Misses, cache.Evictions, cache.Expirations)
+
+		zones, nameservers := lib.DelegationCacheSize()
+		log.Printf("delegation cache zones=%d nameservers=%d", zones, nameservers)
+
+		coalescing := lib.Coalescer.Statistics()
+		log.Printf("resolutions=%d deduplicated queries=%d", coalescing.Resolutions, coalescing.Deduplicated)
+	}
+}
+
+// conditionalForwarders is -forward-zone flag, every occurrence adds one zone to lib.ConditionalForwarders
+type conditionalForwarders struct{}
+
+func (conditionalForwarders) String() string {
+	return ""
+}
+
+func (conditionalForwarders) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected zone=address[,address...], got %q", value)
+	}
+	zone, addresses := parts[0], parts[1]
+
+	servers, err := parseAddresses(addresses)
+	if err != nil {
+		return err
+	}
+
+	lib.ConditionalForwarders[strings.ToLower(strings.TrimSuffix(zone, "."))] = servers
+	return nil
+}
+
+func parseAddresses(value string) ([]string, error) {
+	var addresses []string
+	for _, address := range strings.Split(value, ",") {
+		address = strings.TrimSpace(address)
+		if net.ParseIP(address) == nil {
+			return nil, fmt.Errorf("%q is not an ip address", address)
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}